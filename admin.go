@@ -0,0 +1,354 @@
+package g2cache
+
+import (
+	stdjson "encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	FlushBatchSize = 128 // keys deleted per out storage round trip by Flush
+)
+
+// AdminAuthFunc authorizes a request of the admin handler, a non-nil error is answered with 403
+type AdminAuthFunc func(r *http.Request) error
+
+type PubSubState struct {
+	Enabled    bool `json:"enabled"`
+	Subscribed bool `json:"subscribed"`
+}
+
+type AdminStats struct {
+	GID     string         `json:"gid"`
+	Hit     HitStatistics  `json:"hit"`
+	Pool    PoolStatistics `json:"pool"`
+	Breaker int32          `json:"breaker"` // BreakerClosed, BreakerOpen or BreakerHalfOpen
+	PubSub  PubSubState    `json:"pubsub"`
+}
+
+// KeyTierInfo describes the entry of a key in one storage
+type KeyTierInfo struct {
+	Found       bool          `json:"found"`
+	Ttl         time.Duration `json:"ttl"`
+	Obsolete    time.Time     `json:"obsolete"`
+	Expiration  time.Time     `json:"expiration"`
+	ObsoleteTTL time.Duration `json:"obsolete_ttl"`
+	ExpireTTL   time.Duration `json:"expire_ttl"`
+	Size        int           `json:"size"` // bytes of the encoded value
+}
+
+type KeyInfo struct {
+	Key   string      `json:"key"`
+	Local KeyTierInfo `json:"local"`
+	Out   KeyTierInfo `json:"out"`
+}
+
+// PubSubState reports whether this instance receives changes of other instances
+func (g *G2Cache) PubSubState() PubSubState {
+	_, ok := g.out.(PubSub)
+	return PubSubState{
+		Enabled:    ok && OutCachePubSub,
+		Subscribed: atomic.LoadInt32(&g.subscribed) == 1,
+	}
+}
+
+// Inspect describes key in both storages without loading or refreshing it
+func (g *G2Cache) Inspect(key string) (info *KeyInfo, err error) {
+	defer func() {
+		err = withOp(OpInspect, err)
+	}()
+	select {
+	case <-g.stop:
+		return nil, CacheClose
+	default:
+	}
+	if key == "" {
+		return nil, CacheKeyEmpty
+	}
+	info = &KeyInfo{Key: key}
+	now := g.clock.Now()
+	e, ok, err := g.localGet(key, rawValue())
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		info.Local = keyTierInfo(e, now)
+	}
+	e, ok, err = g.outGet(key, rawValue())
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		info.Out = keyTierInfo(e, now)
+	}
+	return info, nil
+}
+
+func keyTierInfo(e *Entry, now time.Time) KeyTierInfo {
+	info := KeyTierInfo{
+		Found:       true,
+		Ttl:         e.Ttl,
+		Obsolete:    time.Unix(0, e.Obsolete*int64(time.Millisecond)),
+		Expiration:  time.Unix(0, e.Expiration*int64(time.Millisecond)),
+		ObsoleteTTL: e.ObsoleteTTLAt(now),
+		ExpireTTL:   e.ExpireTTLAt(now),
+	}
+	if raw, ok := e.Value.(*stdjson.RawMessage); ok {
+		info.Size = len(*raw)
+	}
+	return info
+}
+
+// RefreshLocal replaces the local value of key with the one in out storage, or drops it if out storage does not have it
+func (g *G2Cache) RefreshLocal(key string) (err error) {
+	defer func() {
+		err = withOp(OpRefresh, err)
+	}()
+	select {
+	case <-g.stop:
+		return CacheClose
+	default:
+	}
+	if key == "" {
+		return CacheKeyEmpty
+	}
+	e, ok, err := g.outGet(key, rawValue())
+	if err != nil {
+		return err
+	}
+	if !ok || e.ExpiredAt(g.clock.Now()) {
+		return g.localDel(key)
+	}
+	return g.localSet(key, e)
+}
+
+// Flush deletes every key with prefix from both storages and publishes the deletes, it return how many keys were deleted.
+// Keys are deleted while they are scanned, FlushBatchSize at a time. Out storage must implement ScanOutCache and local storage RangeLocalCache
+func (g *G2Cache) Flush(prefix string) (n int, err error) {
+	defer func() {
+		err = withOp(OpFlush, err)
+	}()
+	select {
+	case <-g.stop:
+		return 0, CacheClose
+	default:
+	}
+	if prefix == "" {
+		return 0, CacheKeyEmpty
+	}
+	scan, ok := g.out.(ScanOutCache)
+	if !ok {
+		return 0, OutStorageNotImplementScan
+	}
+	ranger, ok := g.local.(RangeLocalCache)
+	if !ok {
+		return 0, LocalStorageNotImplementRange
+	}
+	batch := make([]string, 0, FlushBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		select {
+		case <-g.stop:
+			return CacheClose
+		default:
+		}
+		err := g.delBatch(batch)
+		if err == nil {
+			n += len(batch)
+		}
+		batch = batch[:0]
+		return err
+	}
+	var flushErr error
+	err = scan.Scan(prefix, func(key string) bool {
+		batch = append(batch, key)
+		if len(batch) >= FlushBatchSize {
+			flushErr = flush()
+		}
+		return flushErr == nil
+	})
+	if err != nil {
+		return n, tierErr(prefix, TierOut, err)
+	}
+	if flushErr == nil {
+		flushErr = flush()
+	}
+	if flushErr != nil {
+		return n, flushErr
+	}
+	// keys only in local storage, local storage is not modified while it is ranged
+	var local []string
+	err = ranger.Range(func(key string, e *Entry) bool {
+		if strings.HasPrefix(key, prefix) {
+			local = append(local, key)
+		}
+		return true
+	})
+	if err != nil {
+		return n, tierErr(prefix, TierLocal, err)
+	}
+	for _, key := range local {
+		batch = append(batch, key)
+		if len(batch) >= FlushBatchSize {
+			if err = flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, flush()
+}
+
+// delBatch deletes keys from both storages, with one out storage round trip if it implements BatchOutCache.
+// The deletes are published in one message only when write batching is on, since older instances drop batch messages
+func (g *G2Cache) delBatch(keys []string) error {
+	metas := make([]*ChannelMeta, 0, len(keys))
+	for _, key := range keys {
+		if g.batcher != nil {
+			g.batcher.cancel(key)
+		}
+		metas = append(metas, &ChannelMeta{Key: key, Action: DelPublishType})
+	}
+	if err := g.outBatch(metas); err != nil {
+		return tierErr(keys[0], TierOut, err)
+	}
+	for _, key := range keys {
+		if err := g.localDel(key); err != nil {
+			return tierErr(key, TierLocal, err)
+		}
+		g.emit(cacheEvent{kind: eventDel, key: key})
+	}
+	if g.batcher != nil {
+		return tierErr(keys[0], TierOut, g.publishBatch(metas))
+	}
+	for _, meta := range metas {
+		if err := g.publish(meta.Key, DelPublishType, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type adminHandler struct {
+	g    *G2Cache
+	auth AdminAuthFunc
+	mux  *http.ServeMux
+}
+
+// NewAdminHandler serves, relative to where it is mounted (see http.StripPrefix):
+//
+//	GET  /stats                 AdminStats
+//	GET  /key?key=              KeyInfo
+//	POST /key/delete?key=       Del
+//	POST /key/refresh?key=      RefreshLocal
+//	POST /flush?prefix=         Flush
+//	GET  /hotkeys?n=20          HotKeys
+//
+// Every request is passed to auth first. With a nil auth only GET requests are served
+func NewAdminHandler(g *G2Cache, auth AdminAuthFunc) http.Handler {
+	h := &adminHandler{g: g, auth: auth, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/stats", h.get(h.stats))
+	h.mux.HandleFunc("/key", h.get(h.key))
+	h.mux.HandleFunc("/key/delete", h.post(h.del))
+	h.mux.HandleFunc("/key/refresh", h.post(h.refresh))
+	h.mux.HandleFunc("/flush", h.post(h.flush))
+	h.mux.HandleFunc("/hotkeys", h.get(h.hotKeys))
+	return h
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.auth != nil {
+		if err := h.auth(r); err != nil {
+			h.reply(w, http.StatusForbidden, nil, err)
+			return
+		}
+	} else if r.Method != http.MethodGet {
+		h.reply(w, http.StatusForbidden, nil, errors.New("admin writes need an auth func"))
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *adminHandler) get(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			h.reply(w, http.StatusMethodNotAllowed, nil, errors.New("method not allowed"))
+			return
+		}
+		f(w, r)
+	}
+}
+
+func (h *adminHandler) post(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			h.reply(w, http.StatusMethodNotAllowed, nil, errors.New("method not allowed"))
+			return
+		}
+		f(w, r)
+	}
+}
+
+func (h *adminHandler) reply(w http.ResponseWriter, status int, v interface{}, err error) {
+	if err != nil {
+		if status == http.StatusOK {
+			status = http.StatusInternalServerError
+			if errors.Is(err, CacheKeyEmpty) {
+				status = http.StatusBadRequest
+			}
+		}
+		v = map[string]string{"error": err.Error()}
+	}
+	b, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(b)
+}
+
+func (h *adminHandler) stats(w http.ResponseWriter, r *http.Request) {
+	h.reply(w, http.StatusOK, &AdminStats{
+		GID:     h.g.GID,
+		Hit:     HitStatisticsOut.Snapshot(),
+		Pool:    h.g.PoolStatistics(),
+		Breaker: h.g.OutBreakerState(),
+		PubSub:  h.g.PubSubState(),
+	}, nil)
+}
+
+func (h *adminHandler) key(w http.ResponseWriter, r *http.Request) {
+	info, err := h.g.Inspect(r.URL.Query().Get("key"))
+	h.reply(w, http.StatusOK, info, err)
+}
+
+func (h *adminHandler) del(w http.ResponseWriter, r *http.Request) {
+	err := h.g.Del(r.URL.Query().Get("key"), true)
+	h.reply(w, http.StatusOK, map[string]bool{"ok": true}, err)
+}
+
+func (h *adminHandler) refresh(w http.ResponseWriter, r *http.Request) {
+	err := h.g.RefreshLocal(r.URL.Query().Get("key"))
+	h.reply(w, http.StatusOK, map[string]bool{"ok": true}, err)
+}
+
+func (h *adminHandler) flush(w http.ResponseWriter, r *http.Request) {
+	n, err := h.g.Flush(r.URL.Query().Get("prefix"))
+	h.reply(w, http.StatusOK, map[string]int{"deleted": n}, err)
+}
+
+func (h *adminHandler) hotKeys(w http.ResponseWriter, r *http.Request) {
+	n := 20
+	if s := r.URL.Query().Get("n"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			h.reply(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		n = v
+	}
+	h.reply(w, http.StatusOK, h.g.HotKeys(n), nil)
+}
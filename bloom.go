@@ -0,0 +1,176 @@
+package g2cache
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// KeyFilter answers whether a key may exist in the data source, false must be definite. See WithKeyFilter
+type KeyFilter interface {
+	Add(key string) error
+	MayContain(key string) (bool, error)
+}
+
+// KeyEnumerator passes every existing key of the data source to add, it is run once in background by New
+type KeyEnumerator func(add func(key string) error) error
+
+// WithKeyFilter makes Get return CacheKeyNotFound for keys rejected by f instead of loading them from the data source.
+// f is only asked once both storages miss, so a filter kept in out storage adds no round trip to cache hits.
+// Keys are added to f on Set, Update and successful loads. With enumerate, f is only trusted after enumerate returned nil,
+// without it f is trusted from the start, so every existing key must have been added through Set or f.Add
+func WithKeyFilter(f KeyFilter, enumerate KeyEnumerator) Option {
+	return func(g *G2Cache) {
+		g.filter = f
+		g.filterEnumerate = enumerate
+	}
+}
+
+// populateFilter fills the key filter from the enumerator, Get fails open until it is done
+func (g *G2Cache) populateFilter() {
+	err := g.filterEnumerate(func(key string) error {
+		select {
+		case <-g.stop:
+			return CacheClose
+		default:
+		}
+		return g.filter.Add(key)
+	})
+	if err != nil {
+		LogErrW("key filter populate failed, filter disabled", FieldGid(g.GID), FieldErr(err))
+		return
+	}
+	atomic.StoreInt32(&g.filterReady, 1)
+	LogInfoW("key filter populated", FieldGid(g.GID))
+}
+
+// filterRejects reports whether key definitely does not exist, filter errors fail open
+func (g *G2Cache) filterRejects(key string) bool {
+	if g.filter == nil || atomic.LoadInt32(&g.filterReady) == 0 {
+		return false
+	}
+	ok, err := g.filter.MayContain(key)
+	if err != nil {
+		LogErrW("key filter check failed", FieldKey(key), FieldErr(err))
+		return false
+	}
+	if !ok {
+		atomic.AddInt64(&HitStatisticsOut.FilterRejectTotal, 1)
+	}
+	return !ok
+}
+
+func (g *G2Cache) filterAdd(key string) {
+	if g.filter == nil {
+		return
+	}
+	if err := g.filter.Add(key); err != nil {
+		LogErrW("key filter add failed", FieldKey(key), FieldErr(err))
+	}
+}
+
+// bloomShape return the bit count and hash count for n keys at false positive rate p
+func bloomShape(n int, p float64) (m uint64, k int) {
+	if n < 1 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m = uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k = int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return m, k
+}
+
+// bloomBits derives the k bit offsets of key by double hashing
+func bloomBits(key string, m uint64, k int) []uint64 {
+	h := fnv64a{}.Sum64(key)
+	h1, h2 := h&math.MaxUint32, h>>32|1
+	bits := make([]uint64, k)
+	for i := range bits {
+		bits[i] = (h1 + uint64(i)*h2) % m
+	}
+	return bits
+}
+
+// BloomFilter is an in-memory KeyFilter local to one instance
+type BloomFilter struct {
+	words []uint64
+	m     uint64
+	k     int
+}
+
+// NewBloomFilter sizes the filter for n keys at false positive rate p
+func NewBloomFilter(n int, p float64) *BloomFilter {
+	m, k := bloomShape(n, p)
+	return &BloomFilter{
+		words: make([]uint64, (m+63)/64),
+		m:     m,
+		k:     k,
+	}
+}
+
+func (b *BloomFilter) Add(key string) error {
+	for _, bit := range bloomBits(key, b.m, b.k) {
+		addr := &b.words[bit/64]
+		mask := uint64(1) << (bit % 64)
+		for {
+			old := atomic.LoadUint64(addr)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(addr, old, old|mask) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (b *BloomFilter) MayContain(key string) (bool, error) {
+	for _, bit := range bloomBits(key, b.m, b.k) {
+		if atomic.LoadUint64(&b.words[bit/64])&(uint64(1)<<(bit%64)) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// RedisBloomFilter is a KeyFilter kept as a Redis bitmap, shared by all instances using the same name.
+// It survives restarts, so it does not need to be populated again
+type RedisBloomFilter struct {
+	r    *RedisCache
+	name string
+	m    uint64
+	k    int
+}
+
+// NewRedisBloomFilter sizes the bitmap name for n keys at false positive rate p, all instances must use the same n and p
+func NewRedisBloomFilter(r *RedisCache, name string, n int, p float64) *RedisBloomFilter {
+	m, k := bloomShape(n, p)
+	return &RedisBloomFilter{r: r, name: name, m: m, k: k}
+}
+
+func (b *RedisBloomFilter) Add(key string) error {
+	bits := bloomBits(key, b.m, b.k)
+	cmds := make([]RedisCmd, 0, len(bits))
+	for _, bit := range bits {
+		cmds = append(cmds, RedisCmd{Name: "SETBIT", Args: []interface{}{b.name, bit, 1}})
+	}
+	return RedisPipeline(cmds, b.r.pool)
+}
+
+func (b *RedisBloomFilter) MayContain(key string) (bool, error) {
+	set, err := RedisGetBits(b.name, bloomBits(key, b.m, b.k), b.r.pool)
+	if err != nil {
+		return false, err
+	}
+	for _, ok := range set {
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,46 @@
+package g2cache
+
+import (
+	"time"
+)
+
+// Clock is the time source of a G2Cache, tests replace it with WithClock to control expiry without sleeping
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Optional, storage that tracks expiry itself is given the clock of the G2Cache by New
+type ClockAware interface {
+	SetClock(c Clock)
+}
+
+// SystemClock is the default Clock, backed by package time
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t systemTicker) Stop() {
+	t.t.Stop()
+}
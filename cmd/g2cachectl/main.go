@@ -0,0 +1,381 @@
+// Command g2cachectl inspects the Redis tier of g2cache, it understands the Entry and ChannelMeta formats.
+//
+//	g2cachectl [-addr 127.0.0.1:6379 -pwd "" -db 0 -pubsub-addr "" -channel g2cache-pubsub-channel] <command> [args]
+//
+//	get <key>...                  print entries with their obsolete and expiration times
+//	del [-publish] <key>...       delete keys, -publish also invalidates them on every instance
+//	tail                          print the changes published by instances
+//	scan [-top 10] <pattern>      count the keys matching pattern and their sizes
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"gitee.com/kelvins-io/g2cache"
+	"github.com/gomodule/redigo/redis"
+	"os"
+	"sort"
+	"time"
+)
+
+const ctlGid = "g2cachectl"
+
+var (
+	conf       g2cache.RedisConf
+	pubsubAddr string
+	channel    string
+)
+
+func main() {
+	flag.StringVar(&conf.DSN, "addr", "127.0.0.1:6379", "redis address")
+	flag.StringVar(&conf.Pwd, "pwd", "", "redis password")
+	flag.IntVar(&conf.DB, "db", 0, "redis db")
+	flag.StringVar(&pubsubAddr, "pubsub-addr", "", "redis address of the pubsub channel if it differs from -addr, see DefaultPubSubRedisConf")
+	flag.StringVar(&channel, "channel", g2cache.DefaultPubSubRedisChannel, "pubsub channel of g2cache")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	conf.MaxConn = 2
+
+	pool, err := g2cache.GetRedisPool(&conf)
+	if err != nil {
+		fatal(err)
+	}
+	defer pool.Close()
+	pubsub := pool
+	if pubsubAddr != "" && pubsubAddr != conf.DSN {
+		pubsubConf := conf
+		pubsubConf.DSN = pubsubAddr
+		pubsub, err = g2cache.GetRedisPool(&pubsubConf)
+		if err != nil {
+			fatal(err)
+		}
+		defer pubsub.Close()
+	}
+
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "get":
+		err = get(pool, args)
+	case "del":
+		err = del(pool, pubsub, args)
+	case "tail":
+		err = tail(pubsub)
+	case "scan":
+		err = scan(pool, args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: g2cachectl [flags] get|del|tail|scan [args]")
+	flag.PrintDefaults()
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "g2cachectl:", err)
+	os.Exit(1)
+}
+
+// decodeEntry decodes an Entry keeping its value encoded, entries of older versions included
+func decodeEntry(b []byte) (*g2cache.Entry, error) {
+	raw := new(json.RawMessage)
+	e := &g2cache.Entry{Value: raw}
+	if err := json.Unmarshal(b, e); err != nil {
+		return nil, err
+	}
+	if e.Expiration == 0 {
+		return nil, fmt.Errorf("not a g2cache entry")
+	}
+	return e, nil
+}
+
+type entryView struct {
+	Key         string          `json:"key"`
+	Ttl         string          `json:"ttl"`
+	Obsolete    time.Time       `json:"obsolete"`
+	Expiration  time.Time       `json:"expiration"`
+	ObsoleteTTL string          `json:"obsolete_ttl"`
+	ExpireTTL   string          `json:"expire_ttl"`
+	RedisTTL    string          `json:"redis_ttl,omitempty"`
+	Size        int             `json:"size"`
+	Value       json.RawMessage `json:"value"`
+}
+
+func view(key string, e *g2cache.Entry, size int, now time.Time) *entryView {
+	obsolete := time.Unix(0, e.Obsolete*int64(time.Millisecond))
+	expiration := time.Unix(0, e.Expiration*int64(time.Millisecond))
+	v := &entryView{
+		Key:         key,
+		Ttl:         e.Ttl.String(),
+		Obsolete:    obsolete,
+		Expiration:  expiration,
+		ObsoleteTTL: obsolete.Sub(now).Round(time.Millisecond).String(),
+		ExpireTTL:   expiration.Sub(now).Round(time.Millisecond).String(),
+		Size:        size,
+	}
+	if raw, ok := e.Value.(*json.RawMessage); ok {
+		v.Value = *raw
+	}
+	return v
+}
+
+func printJSON(v interface{}, indent bool) {
+	var b []byte
+	if indent {
+		b, _ = json.MarshalIndent(v, "", "  ")
+	} else {
+		b, _ = json.Marshal(v)
+	}
+	fmt.Println(string(b))
+}
+
+func get(pool *redis.Pool, keys []string) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("get needs a key")
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	for _, key := range keys {
+		s, err := redis.String(conn.Do("GET", key))
+		if err == redis.ErrNil {
+			fmt.Fprintf(os.Stderr, "%s: not found\n", key)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		e, err := decodeEntry([]byte(s))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: not a g2cache entry: %s\n", key, s)
+			continue
+		}
+		v := view(key, e, len(s), time.Now())
+		if pttl, err := redis.Int64(conn.Do("PTTL", key)); err == nil && pttl >= 0 {
+			v.RedisTTL = (time.Duration(pttl) * time.Millisecond).String()
+		}
+		printJSON(v, true)
+	}
+	return nil
+}
+
+func del(pool, pubsub *redis.Pool, args []string) error {
+	fs := flag.NewFlagSet("del", flag.ExitOnError)
+	publish := fs.Bool("publish", false, "publish DelPublishType so that every instance drops its local copy")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("del needs a key")
+	}
+	for _, key := range fs.Args() {
+		if err := g2cache.RedisDelKey(key, pool); err != nil {
+			return err
+		}
+		if *publish {
+			b, err := json.Marshal(&g2cache.ChannelMeta{Key: key, Gid: ctlGid, Action: g2cache.DelPublishType})
+			if err != nil {
+				return err
+			}
+			if err = g2cache.RedisPublish(channel, string(b), pubsub); err != nil {
+				return err
+			}
+		}
+		fmt.Println("deleted", key)
+	}
+	return nil
+}
+
+// channelMeta is g2cache.ChannelMeta with the entry left to decodeEntry
+type channelMeta struct {
+	Key    string          `json:"key"`
+	Gid    string          `json:"gid"`
+	Action int8            `json:"action"`
+	Data   json.RawMessage `json:"data"`
+	Batch  []*channelMeta  `json:"batch,omitempty"`
+}
+
+type metaView struct {
+	Time   time.Time  `json:"time"`
+	Gid    string     `json:"gid"`
+	Action string     `json:"action"`
+	Key    string     `json:"key"`
+	Entry  *entryView `json:"entry,omitempty"`
+}
+
+func actionName(action int8) string {
+	switch action {
+	case g2cache.SetPublishType:
+		return "set"
+	case g2cache.DelPublishType:
+		return "del"
+	case g2cache.BatchPublishType:
+		return "batch"
+	}
+	return fmt.Sprint(action)
+}
+
+// decodeMessage return one view per change of a published message, a batch message holds several
+func decodeMessage(data []byte, now time.Time) ([]*metaView, error) {
+	var meta channelMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	metas := []*channelMeta{&meta}
+	if meta.Action == g2cache.BatchPublishType {
+		metas = meta.Batch
+	}
+	views := make([]*metaView, 0, len(metas))
+	for _, m := range metas {
+		if m == nil {
+			continue
+		}
+		mv := &metaView{Time: now, Gid: meta.Gid, Action: actionName(m.Action), Key: m.Key}
+		if len(m.Data) > 0 && string(m.Data) != "null" {
+			e, err := decodeEntry(m.Data)
+			if err != nil {
+				return nil, err
+			}
+			size := 0
+			if raw, ok := e.Value.(*json.RawMessage); ok {
+				size = len(*raw)
+			}
+			mv.Entry = view(m.Key, e, size, now)
+		}
+		views = append(views, mv)
+	}
+	return views, nil
+}
+
+func tail(pool *redis.Pool) error {
+	conn := pool.Get()
+	defer conn.Close()
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(channel); err != nil {
+		return err
+	}
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			views, err := decodeMessage(v.Data, time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "undecodable message: %s\n", v.Data)
+				continue
+			}
+			for _, mv := range views {
+				printJSON(mv, false)
+			}
+		case redis.Subscription:
+			fmt.Fprintf(os.Stderr, "%s %s\n", v.Kind, v.Channel)
+		case error:
+			return v
+		}
+	}
+}
+
+type keySize struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// largest keeps the n largest keys seen, as a min-heap on Size
+type largest struct {
+	n    int
+	keys []keySize
+}
+
+func (l *largest) Len() int           { return len(l.keys) }
+func (l *largest) Less(i, j int) bool { return l.keys[i].Size < l.keys[j].Size }
+func (l *largest) Swap(i, j int)      { l.keys[i], l.keys[j] = l.keys[j], l.keys[i] }
+func (l *largest) Push(x interface{}) { l.keys = append(l.keys, x.(keySize)) }
+func (l *largest) Pop() interface{} {
+	k := l.keys[len(l.keys)-1]
+	l.keys = l.keys[:len(l.keys)-1]
+	return k
+}
+
+func (l *largest) add(k keySize) {
+	if l.n <= 0 {
+		return
+	}
+	if len(l.keys) < l.n {
+		heap.Push(l, k)
+		return
+	}
+	if k.Size > l.keys[0].Size {
+		l.keys[0] = k
+		heap.Fix(l, 0)
+	}
+}
+
+// sorted return the kept keys, largest first
+func (l *largest) sorted() []keySize {
+	keys := append([]keySize(nil), l.keys...)
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Size > keys[j].Size
+	})
+	return keys
+}
+
+type scanStats struct {
+	Pattern string    `json:"pattern"`
+	Keys    int       `json:"keys"`
+	Strings int       `json:"strings"` // g2cache entries and counters are strings
+	Bytes   int64     `json:"bytes"`   // total size of the strings
+	Avg     int64     `json:"avg"`
+	Max     int64     `json:"max"`
+	Largest []keySize `json:"largest"`
+}
+
+func scan(pool *redis.Pool, args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	top := fs.Int("top", 10, "list this many largest keys")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("scan needs one pattern")
+	}
+	stats := &scanStats{Pattern: fs.Arg(0)}
+	sizes := &largest{n: *top}
+	conn := pool.Get()
+	defer conn.Close()
+	var err error
+	scanErr := g2cache.RedisScan(stats.Pattern, pool, func(key string) bool {
+		stats.Keys++
+		var size int64
+		size, err = redis.Int64(conn.Do("STRLEN", key))
+		if err != nil {
+			if _, ok := err.(redis.Error); ok { // WRONGTYPE, not a string
+				err = nil
+				return true
+			}
+			return false
+		}
+		stats.Strings++
+		stats.Bytes += size
+		if size > stats.Max {
+			stats.Max = size
+		}
+		sizes.add(keySize{Key: key, Size: size})
+		return true
+	})
+	if scanErr != nil {
+		return scanErr
+	}
+	if err != nil {
+		return err
+	}
+	if stats.Strings > 0 {
+		stats.Avg = stats.Bytes / int64(stats.Strings)
+	}
+	stats.Largest = sizes.sorted()
+	printJSON(stats, true)
+	return nil
+}
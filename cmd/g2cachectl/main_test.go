@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gitee.com/kelvins-io/g2cache"
+	"testing"
+	"time"
+)
+
+func TestView(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	b, err := json.Marshal(g2cache.NewEntryAt(map[string]int{"a": 1}, 1500*time.Millisecond, time.Minute, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := decodeEntry(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := view("k", e, len(b), now.Add(time.Second))
+	if v.Key != "k" || v.Ttl != "1.5s" || v.ObsoleteTTL != "500ms" || v.ExpireTTL != "59s" || v.Size != len(b) {
+		t.Fatalf("got view %+v", v)
+	}
+	if !v.Obsolete.Equal(now.Add(1500*time.Millisecond)) || !v.Expiration.Equal(now.Add(time.Minute)) {
+		t.Fatalf("got obsolete %v, expiration %v", v.Obsolete, v.Expiration)
+	}
+	if string(v.Value) != `{"a":1}` {
+		t.Fatalf("got value %s", v.Value)
+	}
+
+	// entries of versions with second precision
+	e, err = decodeEntry([]byte(`{"value":"x","ttl":60,"obsolete":1600000060,"expiration":1600001920}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := view("old", e, 0, now); v.Ttl != "1m0s" || v.ObsoleteTTL != "1m0s" || string(v.Value) != `"x"` {
+		t.Fatalf("got legacy view %+v", v)
+	}
+	if _, err := decodeEntry([]byte(`42`)); err == nil {
+		t.Fatal("want an error for a counter value")
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	e := g2cache.NewEntryAt("v", time.Minute, time.Hour, now)
+	set, _ := json.Marshal(&g2cache.ChannelMeta{Key: "a", Gid: "g1", Action: g2cache.SetPublishType, Data: e})
+	del, _ := json.Marshal(&g2cache.ChannelMeta{Key: "b", Gid: "g1", Action: g2cache.DelPublishType})
+	batch, _ := json.Marshal(&g2cache.ChannelMeta{Gid: "g2", Action: g2cache.BatchPublishType, Batch: []*g2cache.ChannelMeta{
+		{Key: "c", Action: g2cache.SetPublishType, Data: e},
+		{Key: "d", Action: g2cache.DelPublishType},
+	}})
+
+	for _, tt := range []struct {
+		data []byte
+		want string
+	}{
+		{set, "[g1 set a 1m0s]"},
+		{del, "[g1 del b -]"},
+		{batch, "[g2 set c 1m0s g2 del d -]"},
+	} {
+		views, err := decodeMessage(tt.data, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, v := range views {
+			ttl := "-"
+			if v.Entry != nil {
+				ttl = v.Entry.ObsoleteTTL
+				if string(v.Entry.Value) != `"v"` || v.Entry.Size != 3 {
+					t.Fatalf("got entry %+v", v.Entry)
+				}
+			}
+			got = append(got, v.Gid, v.Action, v.Key, ttl)
+		}
+		if fmt.Sprint(got) != tt.want {
+			t.Fatalf("got %v, want %s", got, tt.want)
+		}
+	}
+	if _, err := decodeMessage([]byte(`not json`), now); err == nil {
+		t.Fatal("want an error for an undecodable message")
+	}
+}
+
+func TestLargest(t *testing.T) {
+	l := &largest{n: 3}
+	for i, size := range []int64{5, 1, 9, 3, 7, 2} {
+		l.add(keySize{Key: fmt.Sprint("k", i), Size: size})
+	}
+	if got := fmt.Sprint(l.sorted()); got != "[{k2 9} {k4 7} {k0 5}]" {
+		t.Fatalf("got %s", got)
+	}
+}
@@ -0,0 +1,218 @@
+package g2cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var (
+	CounterFlushMs        = 1000  // local increments are flushed to out storage at this interval, 0 writes every Incr through
+	CounterFlushThreshold = 100   // a key is flushed early once its pending delta reaches this absolute value
+	CounterValueKeepMs    = 60000 // cluster-wide values read back from out storage are forgotten after this long without pending increments
+)
+
+// counterHub accumulates Incr deltas per key, and caches the cluster-wide values read back from out storage
+type counterHub struct {
+	g       *G2Cache
+	mu      sync.Mutex
+	pending map[string]int64
+	values  map[string]counterValue
+	kick    chan struct{}
+	flushMu sync.Mutex
+	pruned  time.Time // last prune of values
+}
+
+type counterValue struct {
+	v  int64
+	at time.Time
+}
+
+func newCounterHub(g *G2Cache) *counterHub {
+	return &counterHub{
+		g:       g,
+		pending: make(map[string]int64),
+		values:  make(map[string]counterValue),
+		kick:    make(chan struct{}, 1),
+	}
+}
+
+// Incr adds delta to the counter of key. The delta is aggregated locally and flushed to out storage with INCRBY
+// every CounterFlushMs, or once it reaches CounterFlushThreshold. Counter keys share the key space of cached values,
+// they have no TTL in out storage and are kept until Del
+func (g *G2Cache) Incr(key string, delta int64) (err error) {
+	defer func() {
+		err = withOp(OpIncr, err)
+	}()
+	select {
+	case <-g.stop:
+		return CacheClose
+	default:
+	}
+	if key == "" {
+		return CacheKeyEmpty
+	}
+	if _, ok := g.out.(CounterOutCache); !ok {
+		return OutStorageNotImplementCounter
+	}
+	if delta == 0 {
+		return nil
+	}
+	if CounterFlushMs <= 0 {
+		v, err := g.outIncrBy(key, delta)
+		if err != nil {
+			return err
+		}
+		g.counters.store(key, v)
+		return nil
+	}
+	g.counters.add(key, delta)
+	return nil
+}
+
+func (g *G2Cache) Decr(key string, delta int64) error {
+	return g.Incr(key, -delta)
+}
+
+// Counter return the cluster-wide value of key plus the increments of this instance not flushed yet.
+// The out storage value is read again once the cached one is older than maxStale, 0 always reads it
+func (g *G2Cache) Counter(key string, maxStale time.Duration) (v int64, err error) {
+	defer func() {
+		err = withOp(OpCounter, err)
+	}()
+	select {
+	case <-g.stop:
+		return 0, CacheClose
+	default:
+	}
+	if key == "" {
+		return 0, CacheKeyEmpty
+	}
+	if _, ok := g.out.(CounterOutCache); !ok {
+		return 0, OutStorageNotImplementCounter
+	}
+	v, pending, ok := g.counters.get(key, maxStale)
+	if ok {
+		return v + pending, nil
+	}
+	v, err = g.outGetCounter(key)
+	if err != nil {
+		return 0, err
+	}
+	g.counters.store(key, v)
+	_, pending, _ = g.counters.get(key, maxStale)
+	return v + pending, nil
+}
+
+func (c *counterHub) add(key string, delta int64) {
+	c.mu.Lock()
+	c.pending[key] += delta
+	full := CounterFlushThreshold > 0 && abs64(c.pending[key]) >= int64(CounterFlushThreshold)
+	c.mu.Unlock()
+	if full {
+		select {
+		case c.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *counterHub) get(key string, maxStale time.Duration) (v, pending int64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending = c.pending[key]
+	cv, ok := c.values[key]
+	if !ok || c.g.clock.Now().Sub(cv.at) > maxStale {
+		return 0, pending, false
+	}
+	return cv.v, pending, true
+}
+
+func (c *counterHub) store(key string, v int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.g.clock.Now()
+	c.values[key] = counterValue{v: v, at: now}
+	if now.Sub(c.pruned) >= time.Second {
+		c.prune(now)
+	}
+}
+
+// prune forgets the values read back longer than CounterValueKeepMs ago of keys without pending increments, c.mu is held
+func (c *counterHub) prune(now time.Time) {
+	c.pruned = now
+	keep := time.Duration(CounterValueKeepMs) * time.Millisecond
+	for key, cv := range c.values {
+		if _, ok := c.pending[key]; !ok && now.Sub(cv.at) > keep {
+			delete(c.values, key)
+		}
+	}
+}
+
+func (c *counterHub) take() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := c.pending
+	c.pending = make(map[string]int64)
+	return pending
+}
+
+// giveBack keeps a delta that could not be flushed for the next flush
+func (c *counterHub) giveBack(key string, delta int64) {
+	c.mu.Lock()
+	c.pending[key] += delta
+	c.mu.Unlock()
+}
+
+func (c *counterHub) run() {
+	t := c.g.clock.NewTicker(time.Duration(CounterFlushMs) * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.g.stop:
+			return // the pending deltas are drained by G2Cache.Shutdown
+		case <-t.C():
+			c.drain(context.Background(), false)
+		case <-c.kick:
+			c.drain(context.Background(), false)
+		}
+	}
+}
+
+// drain flushes all pending deltas, it return how many keys were dropped because ctx was done first.
+// A delta that fails to flush is kept for the next flush, unless final, then it is dropped as well
+func (c *counterHub) drain(ctx context.Context, final bool) (dropped int) {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	pending := c.take()
+	for key, delta := range pending {
+		select {
+		case <-ctx.Done():
+			return dropped + len(pending)
+		default:
+		}
+		delete(pending, key)
+		if delta == 0 {
+			continue
+		}
+		v, err := c.g.outIncrBy(key, delta)
+		if err != nil {
+			LogErrW("counter flush failed", FieldKey(key), FieldTier(TierOut), FieldErr(err))
+			if final {
+				dropped++
+				continue
+			}
+			c.giveBack(key, delta)
+			continue
+		}
+		c.store(key, v)
+	}
+	return dropped
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -9,41 +9,117 @@ var (
 	EntryLazyFactor = 32
 )
 
+// Obsolete and Expiration are Unix milliseconds, entries written by older versions in Unix seconds are converted when decoded
 type Entry struct {
-	Value      interface{} `json:"value"`
-	TtlSecond  int         `json:"ttl"`
-	Obsolete   int64       `json:"obsolete"`
-	Expiration int64       `json:"expiration"`
+	Value      interface{}   `json:"value"`
+	Ttl        time.Duration `json:"ttl_ns"`
+	Obsolete   int64         `json:"obsolete_ms"`
+	Expiration int64         `json:"expiration_ms"`
+}
+
+// entryJSON is the stored form of Entry. Besides the millisecond fields it carries the second fields written before
+// (ttl in seconds, obsolete and expiration in Unix seconds), so instances of both versions read each other during a rolling deploy
+type entryJSON struct {
+	Value            interface{}   `json:"value"`
+	Ttl              time.Duration `json:"ttl_ns,omitempty"`
+	Obsolete         int64         `json:"obsolete_ms,omitempty"`
+	Expiration       int64         `json:"expiration_ms,omitempty"`
+	TtlSecond        int           `json:"ttl"`
+	ObsoleteSecond   int64         `json:"obsolete"`
+	ExpirationSecond int64         `json:"expiration"`
+}
+
+func (e Entry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&entryJSON{
+		Value:            e.Value,
+		Ttl:              e.Ttl,
+		Obsolete:         e.Obsolete,
+		Expiration:       e.Expiration,
+		TtlSecond:        int(e.Ttl / time.Second),
+		ObsoleteSecond:   e.Obsolete / 1000,
+		ExpirationSecond: e.Expiration / 1000,
+	})
+}
+
+// UnmarshalJSON decodes the value into e.Value if it is set, see OutCache.Get. Entries without the millisecond fields fall back to the second fields
+func (e *Entry) UnmarshalJSON(b []byte) error {
+	aux := &entryJSON{Value: e.Value}
+	if err := json.Unmarshal(b, aux); err != nil {
+		return err
+	}
+	e.Value, e.Ttl, e.Obsolete, e.Expiration = aux.Value, aux.Ttl, aux.Obsolete, aux.Expiration
+	if e.Ttl == 0 {
+		e.Ttl = time.Duration(aux.TtlSecond) * time.Second
+	}
+	if e.Obsolete == 0 {
+		e.Obsolete = aux.ObsoleteSecond * 1000
+	}
+	if e.Expiration == 0 {
+		e.Expiration = aux.ExpirationSecond * 1000
+	}
+	return nil
+}
+
+func unixMs(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
 }
 
 // Outdated data means that the data is still available, but not up-to-date
 func (e *Entry) Obsoleted() bool {
+	return e.ObsoletedAt(time.Now())
+}
+
+func (e *Entry) ObsoletedAt(now time.Time) bool {
 	if e.Obsolete <= 0 {
 		return true
 	}
-	if e.Obsolete < time.Now().Unix() {
+	if e.Obsolete < unixMs(now) {
 		return true
 	}
 	return false
 }
 
-func (e *Entry) GetObsoleteTTL() (second int64) {
-	return e.Obsolete - time.Now().Unix()
+func (e *Entry) GetObsoleteTTL() time.Duration {
+	return e.ObsoleteTTLAt(time.Now())
+}
+
+func (e *Entry) ObsoleteTTLAt(now time.Time) time.Duration {
+	return time.Duration(e.Obsolete-unixMs(now)) * time.Millisecond
 }
 
 // Expired means that the data is unavailable and data needs to be synchronized
 func (e *Entry) Expired() bool {
+	return e.ExpiredAt(time.Now())
+}
+
+func (e *Entry) ExpiredAt(now time.Time) bool {
 	if e.Expiration <= 0 {
 		return true
 	}
-	if e.Expiration < time.Now().Unix() {
+	if e.Expiration < unixMs(now) {
 		return true
 	}
 	return false
 }
 
-func (e *Entry) GetExpireTTL() (second int64) {
-	return e.Expiration - time.Now().Unix()
+// Stale usable means that the data has expired, but is still within the grace window after Expiration
+func (e *Entry) StaleUsable(grace time.Duration) bool {
+	return e.StaleUsableAt(grace, time.Now())
+}
+
+func (e *Entry) StaleUsableAt(grace time.Duration, now time.Time) bool {
+	if e.Expiration <= 0 || grace <= 0 {
+		return false
+	}
+	return e.Expiration+int64(grace/time.Millisecond) >= unixMs(now)
+}
+
+func (e *Entry) GetExpireTTL() time.Duration {
+	return e.ExpireTTLAt(time.Now())
+}
+
+func (e *Entry) ExpireTTLAt(now time.Time) time.Duration {
+	return time.Duration(e.Expiration-unixMs(now)) * time.Millisecond
 }
 
 func (e *Entry) String() string {
@@ -51,17 +127,34 @@ func (e *Entry) String() string {
 	return s
 }
 
-func NewEntry(v interface{}, second int) *Entry {
-	ttl := second
+// NewEntry the entry is obsolete after ttl and expires after ttl multiplied by EntryLazyFactor
+func NewEntry(v interface{}, ttl time.Duration) *Entry {
+	return NewEntryWithTTL(v, ttl, ttl*time.Duration(EntryLazyFactor))
+}
+
+// NewEntryWithTTL the entry is obsolete after stale and expires after hard
+func NewEntryWithTTL(v interface{}, stale, hard time.Duration) *Entry {
+	return NewEntryAt(v, stale, hard, time.Now())
+}
+
+// NewEntryAt is NewEntryWithTTL with the creation time given by a Clock
+func NewEntryAt(v interface{}, stale, hard time.Duration, now time.Time) *Entry {
 	var od, e int64
-	if second > 0 {
-		od = time.Now().Add(time.Duration(second) * time.Second).Unix()
-		e = time.Now().Add(time.Duration(second*EntryLazyFactor) * time.Second).Unix()
+	if stale > 0 {
+		od = unixMs(now) + durationMs(stale)
+	}
+	if hard > 0 {
+		e = unixMs(now) + durationMs(hard)
 	}
 	return &Entry{
 		Value:      v,
-		TtlSecond:  ttl,
+		Ttl:        stale,
 		Obsolete:   od,
 		Expiration: e,
 	}
 }
+
+// durationMs rounds d up to whole milliseconds
+func durationMs(d time.Duration) int64 {
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
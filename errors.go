@@ -0,0 +1,85 @@
+package g2cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Operations, used as CacheError.Op
+const (
+	OpGet      = "get"
+	OpSet      = "set"
+	OpDel      = "del"
+	OpUpdate   = "update"
+	OpTouch    = "touch"
+	OpTTL      = "ttl"
+	OpPeek     = "peek"
+	OpExists   = "exists"
+	OpIncr     = "incr"
+	OpCounter  = "counter"
+	OpSnapshot = "snapshot"
+	OpRestore  = "restore"
+	OpInspect  = "inspect"
+	OpRefresh  = "refresh"
+	OpFlush    = "flush"
+)
+
+// CacheError is returned for failures of a storage tier or of the data source, errors.Is and errors.As see through it to Err.
+// Argument and state errors such as CacheKeyEmpty and CacheClose are returned as is
+type CacheError struct {
+	Op   string // OpGet, OpSet...
+	Key  string
+	Tier string // TierLocal, TierOut or TierSource, empty for errors of an UpdateFunc
+	Err  error
+}
+
+func (e *CacheError) Error() string {
+	prefix := "g2cache"
+	if e.Op != "" { // errors of background work such as counter flushes have no operation
+		prefix += " " + e.Op
+	}
+	if e.Tier == "" {
+		return fmt.Sprintf("%s key %s: %v", prefix, e.Key, e.Err)
+	}
+	return fmt.Sprintf("%s key %s %s storage: %v", prefix, e.Key, e.Tier, e.Err)
+}
+
+func (e *CacheError) Unwrap() error {
+	return e.Err
+}
+
+// tierErr tags err with where it happened, an error already tagged keeps its tier
+func tierErr(key, tier string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var ce *CacheError
+	if errors.As(err, &ce) {
+		return err
+	}
+	return &CacheError{Key: key, Tier: tier, Err: err}
+}
+
+// withOp sets the operation of a CacheError returned by a public method
+func withOp(op string, err error) error {
+	var ce *CacheError
+	if errors.As(err, &ce) && ce.Op == "" {
+		ce.Op = op
+	}
+	return err
+}
+
+// IsTransient reports whether err may go away by retrying later: timeouts, an unreachable or overloaded out storage,
+// limited or backing off loads, update conflicts and loader errors for which IsRetryable is true
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, target := range []error{OutStorageUnavailable, DataSourceLoadLimited, DataSourceLoadBackoff, UpdateConflict, context.DeadlineExceeded} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return IsRetryable(err) || isOutUnavailable(err)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"gitee.com/kelvins-io/g2cache"
 	"log"
@@ -8,6 +9,7 @@ import (
 	"math/rand"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
 	"sync"
 	"time"
 )
@@ -39,12 +41,18 @@ func main() {
 		return
 	}
 	go func() {
-		http.HandleFunc("/statics", func(writer http.ResponseWriter, request *http.Request) {
-			m := g2cache.HitStatisticsOut.String()
-			_, _ = writer.Write([]byte(m))
-		})
+		// e.g. /admin/stats, /admin/key?key=, /admin/hotkeys, every request needs the token
+		token := os.Getenv("G2CACHE_ADMIN_TOKEN")
+		auth := func(r *http.Request) error {
+			if token == "" || r.Header.Get("Authorization") != "Bearer "+token {
+				return errors.New("invalid admin token")
+			}
+			return nil
+		}
+		http.Handle("/admin/", http.StripPrefix("/admin", g2cache.NewAdminHandler(g2, auth)))
 		port := 6000+rand.Intn(1000)
-		addr := fmt.Sprintf("0.0.0.0:%d",port)
+		// the admin handler can delete keys, keep it off public interfaces
+		addr := fmt.Sprintf("127.0.0.1:%d",port)
 		log.Println("g2cache-example run at",addr)
 		err := http.ListenAndServe(addr, nil)
 		if err != nil {
@@ -92,7 +100,7 @@ func setKey(g2 *g2cache.G2Cache, wg *sync.WaitGroup) {
 				Price: float64(i) / 100,
 			},
 		}
-		err := g2.Set(key, obj, 30, true) // ttl is second
+		err := g2.Set(key, obj, 30*time.Second, true)
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -105,8 +113,7 @@ func getKey(g2 *g2cache.G2Cache, wg *sync.WaitGroup) {
 	for i := 0; i < testTotal; i++ {
 		key := g2cache.GenKey(appName, rand.Intn(math.MaxInt8))
 		var o Object
-		// ttl is second
-		err := g2.Get(key, 30, &o, func() (interface{}, error) {
+		err := g2.Get(key, 30*time.Second, &o, func() (interface{}, error) {
 			time.Sleep(50 * time.Millisecond)
 			return &Object{
 				ID:      i,
@@ -1,6 +1,7 @@
 package g2cache
 
 import (
+	"context"
 	"fmt"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/mohae/deepcopy"
@@ -17,30 +18,60 @@ const (
 )
 
 var (
-	CacheDebug                  bool
-	CacheMonitor                bool
-	OutCachePubSub              bool
-	CacheMonitorSecond          = 5
-	DefaultGPoolWorkerNum       = 200
-	DefaultGPoolJobQueueChanLen = 1000
+	CacheDebug                   bool
+	CacheMonitor                 bool
+	OutCachePubSub               bool
+	CacheMonitorSecond           = 5
+	DefaultGPoolWorkerNum        = 200 // max workers, the pool scales between DefaultGPoolMinWorkerNum and it
+	DefaultGPoolMinWorkerNum     = 16
+	DefaultGPoolWorkerIdleSecond = 60
+	DefaultGPoolOverflow         = PoolOverflowBlock
+	DefaultGPoolJobQueueChanLen  = 1000
+	DefaultGPoolKeyLaneNum       = 32 // async writes of the same key are ordered within one lane
+	CloseTimeoutSecond           = 5  // Close waits this long for pending async writes
+	// Grace window after Entry.Expiration in which an expired value of either storage is still served when the data source fails, 0 disables.
+	// Storages keep values for the window, so local storage serves obsolete values and refreshes them in background until they expire
+	StaleIfErrorSecond = 0
+	// After a data source failure with a stale value served, the key is not reloaded for this long
+	StaleIfErrorBackoffSecond = 3
 )
 
 var HitStatisticsOut HitStatistics
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 type G2Cache struct {
-	GID      string // Identifies the number of an instance
-	out      OutCache
-	local    LocalCache
-	shards   [defaultShards]sync.Mutex
-	hash     Harsher
-	stop     chan struct{}
-	stopOnce sync.Once
-	channel  chan *ChannelMeta
-	gPool    *Pool
-}
-
-func New(out OutCache, local LocalCache) (g *G2Cache, err error) {
+	GID        string // Identifies the number of an instance
+	out        OutCache
+	local      LocalCache
+	shards     [defaultShards]sync.Mutex // guard keyLocks
+	keyLocks   [defaultShards]map[string]*keyMutex
+	hash       Harsher
+	stop       chan struct{}
+	stopOnce   sync.Once
+	channel    chan *ChannelMeta
+	gPool      *Pool
+	backoff    sync.Map // key => unix second before which the data source is not reloaded
+	breaker    *outBreaker
+	listeners  *listenerHub
+	batcher    *writeBatcher // nil if write batching is disabled
+	counters   *counterHub
+	clock      Clock
+	hot        *hotKeyTracker
+	subscribed int32 // 1 while the out storage subscription is running
+	// optional key filter, see WithKeyFilter
+	filter          KeyFilter
+	filterEnumerate KeyEnumerator
+	filterReady     int32 // 1 once filter may reject keys
+	// loader defaults, see WithDefaultLoaderTimeout and WithDefaultLoaderRetry
+	loaderTimeout time.Duration
+	loaderRetry   int
+	loaderBackoff time.Duration
+	limiters      []*loadLimiter // see WithLoadLimits
+	snapshotFile  string         // see WithSnapshotFile
+}
+
+// New opts are optional, see WithClock
+func New(out OutCache, local LocalCache, opts ...Option) (g *G2Cache, err error) {
 	if local == nil {
 		local = NewFreeCache()
 	}
@@ -55,223 +86,466 @@ func New(out OutCache, local LocalCache) (g *G2Cache, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("gen G2Cache.gid err :%v", err)
 	}
-	LogInfo("[g2cache.gid] = ", gid)
+	LogInfoW("g2cache new", FieldGid(gid))
 	g = &G2Cache{
 		GID:     gid,
 		hash:    new(fnv64a),
 		stop:    make(chan struct{}, 1),
 		channel: make(chan *ChannelMeta, defaultShards),
-		gPool:   NewPool(DefaultGPoolWorkerNum, DefaultGPoolJobQueueChanLen),
+		gPool: NewPoolWithConf(PoolConf{
+			MinWorkers:       DefaultGPoolMinWorkerNum,
+			MaxWorkers:       DefaultGPoolWorkerNum,
+			QueueLen:         DefaultGPoolJobQueueChanLen,
+			WorkerIdleSecond: DefaultGPoolWorkerIdleSecond,
+			Overflow:         DefaultGPoolOverflow,
+		}),
+		clock:     SystemClock,
+		listeners: newListenerHub(),
+		hot:       newHotKeyTracker(),
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(g)
+		}
 	}
+	g.breaker = newOutBreaker(g.clock)
 	g.local = local
 	g.out = out
+	if c, ok := g.local.(ClockAware); ok {
+		c.SetClock(g.clock)
+	}
+	if c, ok := g.out.(ClockAware); ok {
+		c.SetClock(g.clock)
+	}
+	if g.snapshotFile != "" {
+		g.restoreFile()
+	}
 
+	// long-lived loops run outside the worker budget
 	_, ok := g.out.(PubSub)
 	if ok && OutCachePubSub {
-		g.gPool.SendJob(wrapFuncErr(g.subscribe))
+		g.gPool.Go(wrapFuncErr(g.subscribe))
 	}
 
 	HitStatisticsOut.AccessGetTotal = 1
 
 	if CacheMonitor {
-		g.gPool.SendJob(g.monitor)
+		g.gPool.Go(g.monitor)
+	}
+
+	g.gPool.Go(g.dispatchEvents)
+
+	if HotKeyTrackerSize > 0 && HotKeyWindowSecond > 0 {
+		g.gPool.Go(g.rollHotKeys)
+	}
+
+	if g.breaker.enabled() {
+		g.gPool.Go(g.breakerProbe)
+	}
+
+	if AsyncWriteBatchDelayMs > 0 {
+		g.batcher = newWriteBatcher(g)
+		g.gPool.Go(g.batcher.run)
+	}
+
+	if g.filter != nil {
+		if g.filterEnumerate == nil {
+			g.filterReady = 1
+		} else {
+			g.gPool.Go(g.populateFilter)
+		}
+	}
+
+	g.counters = newCounterHub(g)
+	if _, ok := g.out.(CounterOutCache); ok && CounterFlushMs > 0 {
+		g.gPool.Go(g.counters.run)
 	}
 
 	return g, nil
 }
 
+// PoolStatistics return the state and overflow counters of the background job pool
+func (g *G2Cache) PoolStatistics() PoolStatistics {
+	return g.gPool.Statistics()
+}
+
+func (g *G2Cache) localGet(key string, obj interface{}) (*Entry, bool, error) {
+	e, ok, err := g.local.Get(key, obj)
+	return e, ok, tierErr(key, TierLocal, err)
+}
+
+func (g *G2Cache) localSet(key string, e *Entry) error {
+	return tierErr(key, TierLocal, g.local.Set(key, e))
+}
+
+func (g *G2Cache) localDel(key string) error {
+	return tierErr(key, TierLocal, g.local.Del(key))
+}
+
 func (g *G2Cache) monitor() {
-	t := time.NewTicker(time.Duration(CacheMonitorSecond) * time.Second)
+	t := g.clock.NewTicker(time.Duration(CacheMonitorSecond) * time.Second)
+	defer t.Stop()
 	for {
 		select {
 		case <-g.stop:
 			return
-		case <-t.C:
+		case <-t.C():
 			HitStatisticsOut.Calculation()
-			LogDebugF("statistics [\u001B[32mlocal\u001B[0m] hit percentage %.4f", HitStatisticsOut.HitLocalStorageTotalRate*100)
-			LogDebugF("statistics [\u001B[33mout\u001B[0m] hit percentage %.4f", HitStatisticsOut.HitOutStorageTotalRate*100)
-			LogDebugF("statistics [\u001B[31mdata source\u001B[0m] hit percentage %.4f", HitStatisticsOut.HitDataSourceTotalRate*100)
+			LogDebugW("statistics hit percentage", FieldTier(TierLocal), Field("percentage", HitStatisticsOut.HitLocalStorageTotalRate*100))
+			LogDebugW("statistics hit percentage", FieldTier(TierOut), Field("percentage", HitStatisticsOut.HitOutStorageTotalRate*100))
+			LogDebugW("statistics hit percentage", FieldTier(TierSource), Field("percentage", HitStatisticsOut.HitDataSourceTotalRate*100))
 		}
 	}
 }
 
-// Get return err DataSourceLoadNil if fn exec return nil
-func (g *G2Cache) Get(key string, ttlSecond int, obj interface{}, fn LoadDataSourceFunc) error {
+// Get fills obj with the value of key, loading it with fn on a miss. Failures of a storage or of fn are returned as *CacheError,
+// test them with errors.Is, e.g. errors.Is(err, DataSourceLoadNil) if fn returned nil, or with IsTransient
+// When fn fails and an expired value within StaleIfErrorSecond exists, obj is filled with it and a *StaleError is returned, see IsStale
+func (g *G2Cache) Get(key string, ttl time.Duration, obj interface{}, fn LoadDataSourceFunc, opts ...CallOption) error {
+	_, err := g.GetWithInfo(key, ttl, obj, fn, opts...)
+	return err
+}
+
+// checkTTL ttl <= 0 means the default 5s, a positive ttl below 1ms is most likely a count of seconds passed by mistake
+func checkTTL(ttl time.Duration) (time.Duration, error) {
+	if ttl <= 0 {
+		return 5 * time.Second, nil
+	}
+	if ttl < time.Millisecond {
+		return 0, CacheTtlTooShort
+	}
+	return ttl, nil
+}
+
+// GetInfo describes which tier served a Get and how fresh the value is
+type GetInfo struct {
+	Tier             string        `json:"tier"`              // TierLocal, TierOut or TierSource
+	Stale            bool          `json:"stale"`             // an expired value served because the data source failed, see IsStale
+	ObsoleteTTL      time.Duration `json:"obsolete_ttl"`      // negative once obsolete
+	ExpireTTL        time.Duration `json:"expire_ttl"`        // negative once expired
+	RefreshScheduled bool          `json:"refresh_scheduled"` // an obsolete local value is being refreshed in background
+	LoadDuration     time.Duration `json:"load_duration"`     // time spent in the data source
+}
+
+func (i *GetInfo) fill(tier string, e *Entry, now time.Time) {
+	i.Tier = tier
+	i.ObsoleteTTL = e.ObsoleteTTLAt(now)
+	i.ExpireTTL = e.ExpireTTLAt(now)
+}
+
+// GetWithInfo is Get that also reports how the value was served, info is not nil even if err is not nil
+func (g *G2Cache) GetWithInfo(key string, ttl time.Duration, obj interface{}, fn LoadDataSourceFunc, opts ...CallOption) (info *GetInfo, err error) {
+	info = new(GetInfo)
 	select {
 	case <-g.stop:
-		return CacheClose
+		return info, CacheClose
 	default:
 	}
 	if key == "" {
-		return CacheKeyEmpty
+		return info, CacheKeyEmpty
 	}
 	if obj == nil {
-		return CacheObjNil
+		return info, CacheObjNil
 	}
 	if fn == nil {
-		return LoadDataSourceFuncNil
+		return info, LoadDataSourceFuncNil
 	}
-	if ttlSecond <= 0 {
-		ttlSecond = 5
+	ttl, err = checkTTL(ttl)
+	if err != nil {
+		return info, err
 	}
-	return g.get(key, ttlSecond, obj, fn)
+	g.hot.record(key)
+	return info, withOp(OpGet, g.get(key, obj, fn, newCallOptions(ttl, opts), info))
 }
 
-func (g *G2Cache) get(key string, ttlSecond int, obj interface{}, fn LoadDataSourceFunc) error {
+func (g *G2Cache) get(key string, obj interface{}, fn LoadDataSourceFunc, co *callOptions, info *GetInfo) error {
 	atomic.AddInt64(&HitStatisticsOut.AccessGetTotal, 1)
-	v, ok, err := g.local.Get(key, obj) // sync so not need copy obj
-	if err != nil {
-		return err
-	}
-	if ok {
-		atomic.AddInt64(&HitStatisticsOut.HitLocalStorageTotal, 1)
-		if CacheDebug {
-			LogDebugF("key:%-30s => [\u001B[32m hit local storage \u001B[0m]\n", key)
-		}
-		if v.Obsoleted() {
-			to := deepcopy.Copy(obj) // async so copy obj
-			g.gPool.SendJob(func() {
-				// Pass a copy in order to explore the internal structure of obj
-				err := g.syncLocalCache(key, ttlSecond, to, fn)
-				if err != nil {
-					LogErrF("syncMemCache key=%s,err=%v\n", key, err)
-				}
-			})
+	if co.forceRefresh {
+		return g.getFromSource(key, obj, fn, co, info, nil, "")
+	}
+	grace := time.Duration(StaleIfErrorSecond) * time.Second
+	var stale *Entry
+	var staleTier string
+	if co.useLocal() {
+		v, ok, err := g.localGet(key, obj) // sync so not need copy obj
+		if err != nil {
+			return err
 		}
-		return clone(v.Value, obj)
-	}
-	v, ok, err = g.out.Get(key, obj)
-	if err != nil {
-		return err
-	}
-	if ok {
-		if !v.Expired() {
-			atomic.AddInt64(&HitStatisticsOut.HitOutStorageTotal, 1)
+		// local storage keeps a value for whole seconds, an expired value is a miss
+		if ok && !v.ExpiredAt(g.clock.Now()) {
+			atomic.AddInt64(&HitStatisticsOut.HitLocalStorageTotal, 1)
 			if CacheDebug {
-				LogDebugF("key:%-30s => [\u001B[33m hit out storage \u001B[0m]\n", key)
+				LogDebugW("hit", FieldKey(key), FieldTier(TierLocal))
 			}
-			// Prevent penetration of external storage
-			err = g.local.Set(key, v)
-			if err != nil {
-				return err
+			g.emit(cacheEvent{kind: eventLocalHit, key: key})
+			now := g.clock.Now()
+			info.fill(TierLocal, v, now)
+			if v.ObsoletedAt(now) {
+				info.RefreshScheduled = true
+				g.emit(cacheEvent{kind: eventStaleRefresh, key: key})
+				to := deepcopy.Copy(obj) // async so copy obj
+				g.gPool.SendJobWithPriority(func() {
+					// Pass a copy in order to explore the internal structure of obj
+					err := g.syncLocalCache(key, to, fn, co)
+					if err != nil {
+						LogErrW("sync local cache failed", FieldKey(key), FieldErr(err))
+					}
+				}, PriorityLow)
 			}
-			return clone(v.Value, obj)
+			return tierErr(key, TierLocal, clone(v.Value, obj))
+		}
+		if ok && v.StaleUsableAt(grace, g.clock.Now()) {
+			v.Value = deepcopy.Copy(v.Value) // obj is reused by the out storage read
+			stale, staleTier = v, TierLocal
 		}
 	}
-
-	if fn != nil {
-		o, err := g.syncOutCache(key, ttlSecond, fn)
+	if co.useOut() {
+		v, ok, err := g.outGet(key, obj)
 		if err != nil {
-			return err
+			if !g.breaker.enabled() || !isOutUnavailable(err) {
+				return err
+			}
+			// degrade to data source
+			LogErrW("out get failed, degrade to data source", FieldKey(key), FieldTier(TierOut), FieldErr(err))
+		}
+		if ok {
+			now := g.clock.Now()
+			if !v.ExpiredAt(now) {
+				atomic.AddInt64(&HitStatisticsOut.HitOutStorageTotal, 1)
+				if CacheDebug {
+					LogDebugW("hit", FieldKey(key), FieldTier(TierOut))
+				}
+				g.emit(cacheEvent{kind: eventOutHit, key: key})
+				info.fill(TierOut, v, now)
+				// Prevent penetration of external storage
+				if co.useLocal() {
+					err = g.localSet(key, v)
+					if err != nil {
+						return err
+					}
+				}
+				return tierErr(key, TierOut, clone(v.Value, obj))
+			}
+			// the later of the two stale values wins
+			if v.StaleUsableAt(grace, now) && (stale == nil || v.Expiration > stale.Expiration) {
+				stale, staleTier = v, TierOut
+			}
 		}
-		return clone(o, obj)
+	}
+	if stale != nil && g.loadBackingOff(key) {
+		return g.serveStale(key, stale, staleTier, obj, DataSourceLoadBackoff, info)
 	}
 
-	return OutStorageLoadNil
+	return g.getFromSource(key, obj, fn, co, info, stale, staleTier)
 }
 
-func (g *G2Cache) syncLocalCache(key string, ttlSecond int, obj interface{}, fn LoadDataSourceFunc) error {
-	e, ok, err := g.out.Get(key, obj)
+func (g *G2Cache) getFromSource(key string, obj interface{}, fn LoadDataSourceFunc, co *callOptions, info *GetInfo, stale *Entry, staleTier string) error {
+	if fn == nil {
+		return OutStorageLoadNil
+	}
+	// checked only once the storages missed, a remote filter costs nothing on cache hits
+	if stale == nil && g.filterRejects(key) {
+		return CacheKeyNotFound
+	}
+	e, d, err := g.syncOutCache(key, fn, co, stale != nil)
+	info.LoadDuration = d
 	if err != nil {
+		if stale != nil {
+			g.backoffLoad(key)
+			return g.serveStale(key, stale, staleTier, obj, err, info)
+		}
 		return err
 	}
-	if !ok || e.Expired() {
+	info.fill(TierSource, e, g.clock.Now())
+	return tierErr(key, TierSource, clone(e.Value, obj))
+}
+
+func (g *G2Cache) syncLocalCache(key string, obj interface{}, fn LoadDataSourceFunc, co *callOptions) error {
+	var e *Entry
+	var ok bool
+	if co.useOut() {
+		var err error
+		e, ok, err = g.outGet(key, obj)
+		if err != nil {
+			return err
+		}
+	}
+	if !ok || e.ExpiredAt(g.clock.Now()) {
+		if g.loadBackingOff(key) {
+			return nil
+		}
 		atomic.AddInt64(&HitStatisticsOut.HitDataSourceTotal, 1)
 		if CacheDebug {
-			LogDebugF("key:%-30s => [\u001B[31m hit data source \u001B[0m]\n", key)
+			LogDebugW("hit", FieldKey(key), FieldTier(TierSource))
+		}
+		release, err := g.acquireLoad(key, true) // the obsolete local value is served meanwhile
+		if err != nil {
+			g.backoffLoad(key)
+			return tierErr(key, TierSource, err)
 		}
+		defer release()
 		// 从fn里面加载数据
-		g.getShardsLock(key)
-		defer g.releaseShardsLock(key)
+		g.lockKey(key)
+		defer g.unlockKey(key)
 
-		v, err := fn()
+		v, _, err := g.load(key, fn, co)
 		if err != nil {
+			g.backoffLoad(key)
 			return err
 		}
 		if v == nil {
-			return DataSourceLoadNil
+			return tierErr(key, TierSource, DataSourceLoadNil)
 		}
-		e = NewEntry(v, ttlSecond)
-		err = g.local.Set(key, e)
+		g.backoff.Delete(key)
+		e = co.newEntry(v, g.clock.Now())
+		err = g.localSet(key, e)
 		if err != nil {
 			return err
 		}
-		g.gPool.SendJob(func() {
-			_err := g.out.Set(key, e)
-			if _err != nil {
-				LogErr("syncLocalCache out set err:", err)
-				return
-			}
-			pubsub, ok := g.out.(PubSub)
-			if ok && OutCachePubSub {
-				_err = pubsub.Publish(g.GID, key, SetPublishType, e)
-				if _err != nil {
-					LogErr("syncLocalCache Publish err:", err)
-				}
-			}
-		})
+		g.asyncOutSet(key, e, co)
+		return nil
 	}
 
 	atomic.AddInt64(&HitStatisticsOut.HitOutStorageTotal, 1)
 	if CacheDebug {
-		LogDebugF("key:%-30s => [\u001B[33m hit out storage \u001B[0m]\n", key)
+		LogDebugW("hit", FieldKey(key), FieldTier(TierOut))
 	}
 
-	return g.local.Set(key, e)
+	return g.localSet(key, e)
 }
 
-func (g *G2Cache) syncOutCache(key string, ttlSecond int, fn LoadDataSourceFunc) (interface{}, error) {
+// hasStale means that a stale value can be served if the load fails, see LoadLimitServeStale
+func (g *G2Cache) syncOutCache(key string, fn LoadDataSourceFunc, co *callOptions, hasStale bool) (*Entry, time.Duration, error) {
 
 	atomic.AddInt64(&HitStatisticsOut.HitDataSourceTotal, 1)
 	if CacheDebug {
-		LogDebugF("key:%-30s => [\u001B[31m hit data source \u001B[0m]\n", key)
+		LogDebugW("hit", FieldKey(key), FieldTier(TierSource))
+	}
+	release, err := g.acquireLoad(key, hasStale)
+	if err != nil {
+		return nil, 0, tierErr(key, TierSource, err)
 	}
+	defer release()
 	// 从数据源加载
-	g.getShardsLock(key)
-	defer g.releaseShardsLock(key)
+	g.lockKey(key)
+	defer g.unlockKey(key)
 
-	o, err := fn()
+	o, d, err := g.load(key, fn, co)
 	if err != nil {
-		return nil, err
+		return nil, d, err
 	}
 	if o == nil {
-		return nil, DataSourceLoadNil
+		return nil, d, tierErr(key, TierSource, DataSourceLoadNil)
 	}
-	e := NewEntry(o, ttlSecond)
-	err = g.local.Set(key, e)
-	if err != nil {
-		return nil, err
+	g.backoff.Delete(key)
+	e := co.newEntry(o, g.clock.Now())
+	if co.useLocal() {
+		err = g.localSet(key, e)
+		if err != nil {
+			return nil, d, err
+		}
+	}
+	g.asyncOutSet(key, e, co)
+
+	return e, d, nil
+}
+
+// asyncOutSet writes an Entry already stored in local storage to out storage in the background
+func (g *G2Cache) asyncOutSet(key string, e *Entry, co *callOptions) {
+	if !co.useOut() {
+		return
+	}
+	if g.batcher != nil {
+		g.batcher.add(key, SetPublishType, e, co.publish())
+		return
 	}
-	g.gPool.SendJob(func() {
-		_err := g.out.Set(key, e)
+	g.gPool.SendKeyJob(key, func() {
+		_err := g.outSet(key, e)
 		if _err != nil {
+			LogErrW("async out set failed", FieldKey(key), FieldTier(TierOut), FieldErr(_err))
 			return
 		}
-		pubsub, ok := g.out.(PubSub)
-		if ok && OutCachePubSub {
-			_err = pubsub.Publish(g.GID, key, SetPublishType, e)
-			if _err != nil {
-				eS, _ := json.MarshalToString(e)
-				LogErrF("syncOutCache key=%s,val=%s,err=%v\n", key, eS, err)
-			}
+		if !co.publish() {
+			return
+		}
+		_err = g.publish(key, SetPublishType, e)
+		if _err != nil {
+			LogErrW("async out set publish failed", FieldKey(key), FieldTier(TierOut), FieldErr(_err))
 		}
 	})
+}
 
-	return o, err
+// serveStale fills obj with an expired value of tier and reports it with a StaleError wrapping cause
+func (g *G2Cache) serveStale(key string, e *Entry, tier string, obj interface{}, cause error, info *GetInfo) error {
+	info.fill(tier, e, g.clock.Now())
+	info.Stale = true
+	atomic.AddInt64(&HitStatisticsOut.HitStaleTotal, 1)
+	if CacheDebug {
+		LogDebugW("hit stale", FieldKey(key), FieldTier(tier), FieldErr(cause))
+	}
+	if err := clone(e.Value, obj); err != nil {
+		return tierErr(key, tier, err)
+	}
+	return &StaleError{Key: key, Expiration: e.Expiration, Err: cause}
 }
 
+func (g *G2Cache) loadBackingOff(key string) bool {
+	v, ok := g.backoff.Load(key)
+	if !ok {
+		return false
+	}
+	if v.(int64) > g.clock.Now().Unix() {
+		return true
+	}
+	g.backoff.Delete(key)
+	return false
+}
+
+func (g *G2Cache) backoffLoad(key string) {
+	if StaleIfErrorSecond <= 0 || StaleIfErrorBackoffSecond <= 0 {
+		return
+	}
+	g.backoff.Store(key, g.clock.Now().Unix()+int64(StaleIfErrorBackoffSecond))
+}
+
+// keyMutex serializes the loads of one key, refs counts its holder and waiters
+type keyMutex struct {
+	sync.Mutex
+	refs int
+}
+
+// lockKey serializes loads of key without blocking other keys, the shard mutex is only held to find the key mutex.
 // This function may block
-func (g *G2Cache) getShardsLock(key string) {
-	idx := g.hash.Sum64(key)
-	g.shards[idx&defaultShardsAndOpVal].Lock()
+func (g *G2Cache) lockKey(key string) {
+	idx := g.hash.Sum64(key) & defaultShardsAndOpVal
+	g.shards[idx].Lock()
+	m := g.keyLocks[idx][key]
+	if m == nil {
+		if g.keyLocks[idx] == nil {
+			g.keyLocks[idx] = make(map[string]*keyMutex)
+		}
+		m = new(keyMutex)
+		g.keyLocks[idx][key] = m
+	}
+	m.refs++
+	g.shards[idx].Unlock()
+	m.Lock()
 }
 
-func (g *G2Cache) releaseShardsLock(key string) {
-	idx := g.hash.Sum64(key)
-	g.shards[idx&defaultShardsAndOpVal].Unlock()
+func (g *G2Cache) unlockKey(key string) {
+	idx := g.hash.Sum64(key) & defaultShardsAndOpVal
+	g.shards[idx].Lock()
+	m := g.keyLocks[idx][key]
+	m.refs--
+	if m.refs == 0 {
+		delete(g.keyLocks[idx], key)
+	}
+	g.shards[idx].Unlock()
+	m.Unlock()
 }
 
-func (g *G2Cache) Set(key string, obj interface{}, ttlSecond int, wait bool) (err error) {
+// Set with wait false is asynchronous, async Set and Del of the same key are applied in call order
+func (g *G2Cache) Set(key string, obj interface{}, ttl time.Duration, wait bool, opts ...CallOption) (err error) {
 	select {
 	case <-g.stop:
 		return CacheClose
@@ -283,45 +557,70 @@ func (g *G2Cache) Set(key string, obj interface{}, ttlSecond int, wait bool) (er
 	if obj == nil {
 		return CacheObjNil
 	}
-	if ttlSecond <= 0 {
-		ttlSecond = 5
+	ttl, err = checkTTL(ttl)
+	if err != nil {
+		return err
+	}
+	err = withOp(OpSet, g.set(key, obj, wait, newCallOptions(ttl, opts)))
+	if err == nil {
+		g.filterAdd(key)
+		g.emit(cacheEvent{kind: eventSet, key: key})
 	}
-	return g.set(key, obj, ttlSecond, wait)
+	return err
 }
 
-func (g *G2Cache) set(key string, obj interface{}, ttlSecond int, wait bool) (err error) {
-	v := NewEntry(obj, ttlSecond)
+func (g *G2Cache) set(key string, obj interface{}, wait bool, co *callOptions) (err error) {
+	v := co.newEntry(obj, g.clock.Now())
 	if wait {
-		return g.setInternal(key, v)
+		return g.setInternal(key, v, co)
+	}
+	if g.batcher != nil {
+		if co.useLocal() {
+			err = g.localSet(key, v)
+			if err != nil {
+				return err
+			}
+		}
+		if co.useOut() {
+			g.batcher.add(key, SetPublishType, v, co.publish())
+		}
+		return nil
 	}
-	g.gPool.SendJob(func() {
-		_err := g.setInternal(key, v)
+	g.gPool.SendKeyJob(key, func() {
+		_err := g.setInternal(key, v, co)
 		if _err != nil {
-			objS, _ := json.MarshalToString(v)
-			LogErrF("setInternal key: %s,obj: %s ,err: %v", key, objS, err)
+			LogErrW("async set failed", FieldKey(key), FieldErr(_err))
 		}
 	})
 
 	return err
 }
 
-func (g *G2Cache) setInternal(key string, e *Entry) (err error) {
-	err = g.local.Set(key, e)
-	if err != nil {
-		return err
+func (g *G2Cache) setInternal(key string, e *Entry, co *callOptions) (err error) {
+	if g.batcher != nil && co.useOut() {
+		g.batcher.cancel(key)
 	}
-	err = g.out.Set(key, e)
+	if co.useLocal() {
+		err = g.localSet(key, e)
+		if err != nil {
+			return err
+		}
+	}
+	if !co.useOut() {
+		return nil
+	}
+	err = g.outSet(key, e)
 	if err != nil {
 		return err
 	}
-	pubsub, ok := g.out.(PubSub)
-	if ok && OutCachePubSub {
-		return pubsub.Publish(g.GID, key, SetPublishType, e)
+	if !co.publish() {
+		return nil
 	}
-	return nil
+	return g.publish(key, SetPublishType, e)
 }
 
-func (g *G2Cache) Del(key string, wait bool) (err error) {
+// Del with wait false is asynchronous, async Set and Del of the same key are applied in call order
+func (g *G2Cache) Del(key string, wait bool, opts ...CallOption) (err error) {
 	select {
 	case <-g.stop:
 		return CacheClose
@@ -330,38 +629,59 @@ func (g *G2Cache) Del(key string, wait bool) (err error) {
 	if key == "" {
 		return CacheKeyEmpty
 	}
-	return g.del(key, wait)
+	err = withOp(OpDel, g.del(key, wait, newCallOptions(0, opts)))
+	if err == nil {
+		g.emit(cacheEvent{kind: eventDel, key: key})
+	}
+	return err
 }
 
-func (g *G2Cache) del(key string, wait bool) (err error) {
+func (g *G2Cache) del(key string, wait bool, co *callOptions) (err error) {
 	if wait {
-		return g.delInternal(key)
+		return g.delInternal(key, co)
+	}
+	if g.batcher != nil {
+		if co.useLocal() {
+			err = g.localDel(key)
+			if err != nil {
+				return err
+			}
+		}
+		if co.useOut() {
+			g.batcher.add(key, DelPublishType, nil, co.publish())
+		}
+		return nil
 	}
-	g.gPool.SendJob(func() {
-		_err := g.delInternal(key)
+	g.gPool.SendKeyJob(key, func() {
+		_err := g.delInternal(key, co)
 		if _err != nil {
-			LogErrF("delInternal key: %s,err: %v", key, err)
+			LogErrW("async del failed", FieldKey(key), FieldErr(_err))
 		}
 	})
 
 	return nil
 }
 
-func (g *G2Cache) delInternal(key string) (err error) {
+func (g *G2Cache) delInternal(key string, co *callOptions) (err error) {
+	if g.batcher != nil && co.useOut() {
+		g.batcher.cancel(key)
+	}
 	defer func() {
-		if err == nil {
-			err = g.local.Del(key)
+		if err == nil && co.useLocal() {
+			err = g.localDel(key)
 		}
 	}()
-	err = g.out.Del(key)
+	if !co.useOut() {
+		return nil
+	}
+	err = g.outDel(key)
 	if err != nil {
 		return err
 	}
-	pubsub, ok := g.out.(PubSub)
-	if ok && OutCachePubSub {
-		return pubsub.Publish(g.GID, key, DelPublishType, nil)
+	if !co.publish() {
+		return nil
 	}
-	return err
+	return g.publish(key, DelPublishType, nil)
 }
 
 func (g *G2Cache) subscribe() error {
@@ -373,60 +693,72 @@ func (g *G2Cache) subscribe() error {
 	return g.subscribeInternal()
 }
 
+// g.channel is never closed, the subscriber may still be sending to it
 func (g *G2Cache) subscribeHandle() error {
-	for ele := range g.channel {
-		meta := *ele // for range pointer please to do
+	for {
+		var meta ChannelMeta
 		select {
 		case <-g.stop:
-			return OutStorageClose
-		default:
+			return nil
+		case ele := <-g.channel:
+			meta = *ele
 		}
 		if meta.Gid == g.GID {
 			continue
 		}
-		if meta.Key == "" {
-			if CacheDebug {
-				LogDebugF("subscribeHandle receive meta.Key is null: %+v\n", meta)
+		if meta.Action == BatchPublishType {
+			for _, sub := range meta.Batch {
+				if sub == nil {
+					continue
+				}
+				sub.Gid = meta.Gid
+				g.handleMeta(*sub)
 			}
 			continue
 		}
+		g.handleMeta(meta)
+	}
+}
+
+func (g *G2Cache) handleMeta(meta ChannelMeta) {
+	if meta.Key == "" {
 		if CacheDebug {
-			metaDump, _ := json.MarshalToString(meta)
-			LogDebugF("subscribeHandle receive meta: %v\n", metaDump)
+			LogDebugW("subscribe receive meta without key", FieldGid(meta.Gid), Field("action", meta.Action))
 		}
+		return
+	}
+	if CacheDebug {
+		LogDebugW("subscribe receive meta", FieldKey(meta.Key), FieldGid(meta.Gid), Field("action", meta.Action))
+	}
 
-		switch meta.Action {
-		case DelPublishType:
-			g.gPool.SendJob(func() {
-				if err := g.out.Del(meta.Key); err != nil {
-					LogErrF("out del key=%s, err=%v\n", meta.Key, err)
-				}
-				if err := g.local.Del(meta.Key); err != nil {
-					LogErrF("local del key=%s, err=%v\n", meta.Key, err)
-				}
-			})
-		case SetPublishType:
-			if meta.Data.Value == nil {
-				if CacheDebug {
-					LogDebugF("subscribeHandle receive meta.Data is nil: %+v\n", meta)
-				}
-				continue
+	switch meta.Action {
+	case DelPublishType:
+		g.emit(cacheEvent{kind: eventRemoteInvalidate, key: meta.Key, action: meta.Action, gid: meta.Gid})
+		g.gPool.SendKeyJob(meta.Key, func() {
+			if err := g.outDel(meta.Key); err != nil {
+				LogErrW("subscribe del failed", FieldKey(meta.Key), FieldTier(TierOut), FieldErr(err))
 			}
-			g.gPool.SendJob(func() {
-				if err := g.local.Set(meta.Key, meta.Data); err != nil {
-					dataS, _ := json.MarshalToString(meta.Data)
-					LogErrF("local set key=%s,val=%s, err=%v\n", meta.Key, dataS, err)
-				}
-				if err := g.out.Set(meta.Key, meta.Data); err != nil {
-					dataS, _ := json.MarshalToString(meta.Data)
-					LogErrF("out set key=%s,val=%s, err=%v\n", meta.Key, dataS, err)
-				}
-			})
-		default:
-			continue
+			if err := g.localDel(meta.Key); err != nil {
+				LogErrW("subscribe del failed", FieldKey(meta.Key), FieldTier(TierLocal), FieldErr(err))
+			}
+		})
+	case SetPublishType:
+		if meta.Data == nil || meta.Data.Value == nil {
+			if CacheDebug {
+				LogDebugW("subscribe receive meta without data", FieldKey(meta.Key), FieldGid(meta.Gid))
+			}
+			return
 		}
+		g.emit(cacheEvent{kind: eventRemoteInvalidate, key: meta.Key, action: meta.Action, gid: meta.Gid})
+		g.gPool.SendKeyJob(meta.Key, func() {
+			if err := g.localSet(meta.Key, meta.Data); err != nil {
+				LogErrW("subscribe set failed", FieldKey(meta.Key), FieldTier(TierLocal), FieldErr(err))
+			}
+			if err := g.outSet(meta.Key, meta.Data); err != nil {
+				LogErrW("subscribe set failed", FieldKey(meta.Key), FieldTier(TierOut), FieldErr(err))
+			}
+		})
 	}
-	return nil
 }
 
 func (g *G2Cache) subscribeInternal() error {
@@ -435,11 +767,13 @@ func (g *G2Cache) subscribeInternal() error {
 		return CacheNotImplementPubSub
 	}
 
-	g.gPool.SendJob(wrapFuncErr(func() error {
+	g.gPool.Go(wrapFuncErr(func() error {
 		return g.subscribeHandle()
 	}))
 
+	atomic.StoreInt32(&g.subscribed, 1)
 	err := pubsub.Subscribe(g.channel)
+	atomic.StoreInt32(&g.subscribed, 0)
 	if err != nil {
 		return err
 	}
@@ -447,26 +781,60 @@ func (g *G2Cache) subscribeInternal() error {
 	return nil
 }
 
-func (g *G2Cache) close() {
+// close stops accepting new work, waits for the running background jobs, drains queued async writes and their publishes in order,
+// then closes the storages; it return how many writes and background jobs were dropped because ctx was done first
+func (g *G2Cache) close(ctx context.Context) (dropped int, err error) {
 	if g.stop != nil {
 		close(g.stop)
 	}
+	if g.gPool != nil {
+		// a running refresh job may still queue an async write, queued refresh jobs are dropped
+		discarded, _ := g.gPool.StopWorkers(ctx)
+		dropped += discarded
+	}
+	if g.batcher != nil {
+		dropped += g.batcher.drain(ctx)
+	}
+	if g.counters != nil {
+		dropped += g.counters.drain(ctx, true)
+	}
+	if g.gPool != nil {
+		dropped += g.gPool.DrainKeyJobs(ctx)
+	}
 	if g.out != nil {
 		g.out.Close()
 	}
-	if g.out != nil {
+	if g.local != nil {
+		if g.snapshotFile != "" {
+			g.dumpFile()
+		}
 		g.local.Close()
 	}
-	if g.channel != nil {
-		close(g.channel)
-	}
 	if g.gPool != nil {
-		g.gPool.Release()
+		// stores are closed first so that the subscribe loop returns
+		discarded, _ := g.gPool.ReleaseContext(ctx)
+		dropped += discarded
+	}
+	if dropped > 0 {
+		LogWarnW("shutdown dropped jobs", FieldGid(g.GID), Field("dropped", dropped))
 	}
+	return dropped, ctx.Err()
+}
+
+// Shutdown gracefully closes the cache, Get/Set/Del return CacheClose once it starts.
+// If ctx is done before queued async writes are flushed, the rest are dropped and reported with ctx.Err()
+func (g *G2Cache) Shutdown(ctx context.Context) (dropped int, err error) {
+	err = CacheClose
+	g.stopOnce.Do(func() {
+		dropped, err = g.close(ctx)
+	})
+	return dropped, err
 }
 
 func (g *G2Cache) Close() {
-	g.stopOnce.Do(g.close)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(CloseTimeoutSecond)*time.Second)
+	defer cancel()
+	_, _ = g.Shutdown(ctx)
 }
 
 type Harsher interface {
@@ -12,17 +12,50 @@ import (
 )
 
 var (
-	CacheKeyEmpty           = errors.New("cache key is empty")
-	CacheObjNil             = errors.New("cache object is nil")
-	LoadDataSourceFuncNil   = errors.New("cache load func is nil")
-	LocalStorageClose       = errors.New("local storage close !!! ")
-	OutStorageClose         = errors.New("out storage close !!! ")
-	CacheClose              = errors.New("g2cache close !!! ")
-	DataSourceLoadNil       = errors.New("data source load nil")
-	OutStorageLoadNil       = errors.New("out storage load nil")
-	CacheNotImplementPubSub = errors.New("cache not implement pubsub interface")
+	CacheKeyEmpty                 = errors.New("cache key is empty")
+	CacheObjNil                   = errors.New("cache object is nil")
+	LoadDataSourceFuncNil         = errors.New("cache load func is nil")
+	LocalStorageClose             = errors.New("local storage close !!! ")
+	OutStorageClose               = errors.New("out storage close !!! ")
+	CacheClose                    = errors.New("g2cache close !!! ")
+	DataSourceLoadNil             = errors.New("data source load nil")
+	OutStorageLoadNil             = errors.New("out storage load nil")
+	CacheNotImplementPubSub       = errors.New("cache not implement pubsub interface")
+	DataSourceLoadBackoff         = errors.New("data source load backoff")
+	CacheTtlTooShort              = errors.New("cache ttl is shorter than 1ms, ttl is a time.Duration")
+	DataSourceLoadTimeout         = errors.New("data source load timeout")
+	DataSourceLoadLimited         = errors.New("data source load limited")
+	CacheKeyNotFound              = errors.New("cache key not found")
+	UpdateFuncNil                 = errors.New("cache update func is nil")
+	UpdateConflict                = errors.New("cache update conflict, retries exhausted")
+	OutStorageNotImplementCas     = errors.New("out storage not implement cas interface")
+	OutStorageNotImplementCounter = errors.New("out storage not implement counter interface")
+	OutStorageNotImplementScan    = errors.New("out storage not implement scan interface")
+	LocalStorageNotImplementRange = errors.New("local storage not implement range interface")
+	OutStorageUnavailable         = errors.New("out storage unavailable, breaker open")
 )
 
+// StaleError means that obj was filled with an expired value because the data source failed
+type StaleError struct {
+	Key        string
+	Expiration int64 // Expiration of the stale value, Unix milliseconds
+	Err        error // data source error, or DataSourceLoadBackoff
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("key %s serve stale value: %v", e.Key, e.Err)
+}
+
+func (e *StaleError) Unwrap() error {
+	return e.Err
+}
+
+// IsStale reports whether the value returned with err is a usable stale value
+func IsStale(err error) bool {
+	var e *StaleError
+	return errors.As(err, &e)
+}
+
 func clone(src, dst interface{}) (err error) {
 	defer func() {
 		if e := recover(); e != nil {
@@ -78,7 +111,7 @@ func wrapFuncErr(f func() error) func() {
 	return func() {
 		err := f()
 		if err != nil {
-			LogErr(err)
+			LogErrW("job failed", FieldErr(err))
 		}
 	}
 }
@@ -90,6 +123,15 @@ type HitStatistics struct {
 	HitDataSourceTotal       int64   `json:"hit_data_source_total"`
 	HitLocalStorageTotal     int64   `json:"hit_local_storage_total"`
 	HitOutStorageTotal       int64   `json:"hit_out_storage_total"`
+	HitStaleTotal            int64   `json:"hit_stale_total"`
+	OutBreakerOpenTotal      int64   `json:"out_breaker_open_total"`
+	OutWriteDropTotal        int64   `json:"out_write_drop_total"`
+	EventDropTotal           int64   `json:"event_drop_total"`
+	FilterRejectTotal        int64   `json:"filter_reject_total"`
+	LoaderTimeoutTotal       int64   `json:"loader_timeout_total"`
+	LoaderRetryTotal         int64   `json:"loader_retry_total"`
+	LoaderPanicTotal         int64   `json:"loader_panic_total"`
+	LoadLimitedTotal         int64   `json:"load_limited_total"`
 	AccessGetTotal           int64   `json:"access_get_total"`
 }
 
@@ -98,6 +140,29 @@ func (h *HitStatistics) String() string {
 	return v
 }
 
+// Snapshot return a copy read with atomic loads, with the rates calculated on the copy
+func (h *HitStatistics) Snapshot() HitStatistics {
+	c := HitStatistics{
+		HitDataSourceTotal:   atomic.LoadInt64(&h.HitDataSourceTotal),
+		HitLocalStorageTotal: atomic.LoadInt64(&h.HitLocalStorageTotal),
+		HitOutStorageTotal:   atomic.LoadInt64(&h.HitOutStorageTotal),
+		HitStaleTotal:        atomic.LoadInt64(&h.HitStaleTotal),
+		OutBreakerOpenTotal:  atomic.LoadInt64(&h.OutBreakerOpenTotal),
+		OutWriteDropTotal:    atomic.LoadInt64(&h.OutWriteDropTotal),
+		EventDropTotal:       atomic.LoadInt64(&h.EventDropTotal),
+		FilterRejectTotal:    atomic.LoadInt64(&h.FilterRejectTotal),
+		LoaderTimeoutTotal:   atomic.LoadInt64(&h.LoaderTimeoutTotal),
+		LoaderRetryTotal:     atomic.LoadInt64(&h.LoaderRetryTotal),
+		LoaderPanicTotal:     atomic.LoadInt64(&h.LoaderPanicTotal),
+		LoadLimitedTotal:     atomic.LoadInt64(&h.LoadLimitedTotal),
+		AccessGetTotal:       atomic.LoadInt64(&h.AccessGetTotal),
+	}
+	if c.AccessGetTotal > 0 {
+		c.Calculation()
+	}
+	return c
+}
+
 func (h *HitStatistics) Calculation() {
 	h.StatisticsDataSource()
 	h.StatisticsOutStorage()
@@ -0,0 +1,1982 @@
+package g2cache_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gitee.com/kelvins-io/g2cache"
+	"gitee.com/kelvins-io/g2cache/g2cachetest"
+	"hash/fnv"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetExpiryWithFakeClock(t *testing.T) {
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache(), g2cache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	var loads int64
+	load := func() (interface{}, error) {
+		return atomic.AddInt64(&loads, 1), nil
+	}
+	get := func(wantTier string) *g2cache.GetInfo {
+		t.Helper()
+		var v int64
+		info, err := g.GetWithInfo("clock", 10500*time.Millisecond, &v, load, g2cache.WithHardTTL(20*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Tier != wantTier {
+			t.Fatalf("served by %s, want %s", info.Tier, wantTier)
+		}
+		return info
+	}
+
+	get(g2cache.TierSource)
+	get(g2cache.TierLocal)
+	if n := atomic.LoadInt64(&loads); n != 1 {
+		t.Fatalf("loaded %d times, want 1", n)
+	}
+
+	// past Expiration both storages miss
+	clock.Advance(21 * time.Second)
+	get(g2cache.TierSource)
+	if n := atomic.LoadInt64(&loads); n != 2 {
+		t.Fatalf("loaded %d times, want 2", n)
+	}
+
+	// past Obsolete the local value is served and refreshed in background,
+	// freecache keeps it until Obsolete rounded up to whole seconds
+	clock.Advance(10600 * time.Millisecond)
+	if info := get(g2cache.TierLocal); !info.RefreshScheduled || info.ObsoleteTTL >= 0 {
+		t.Fatalf("obsolete value not refreshed: %+v", info)
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	defer func(grace, backoff int) {
+		g2cache.StaleIfErrorSecond, g2cache.StaleIfErrorBackoffSecond = grace, backoff
+	}(g2cache.StaleIfErrorSecond, g2cache.StaleIfErrorBackoffSecond)
+	g2cache.StaleIfErrorSecond = 10
+	g2cache.StaleIfErrorBackoffSecond = 0
+
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache(), g2cache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if err := g.Set("out", "out value", time.Second, true, g2cache.WithHardTTL(2*time.Second), g2cache.WithOutOnly()); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Set("local", "local value", time.Second, true, g2cache.WithHardTTL(2*time.Second), g2cache.WithLocalOnly()); err != nil {
+		t.Fatal(err)
+	}
+	down := errors.New("data source down")
+	fail := func() (interface{}, error) {
+		return nil, down
+	}
+	get := func(key string, opts ...g2cache.CallOption) (string, *g2cache.GetInfo, error) {
+		var v string
+		info, err := g.GetWithInfo(key, time.Second, &v, fail, opts...)
+		return v, info, err
+	}
+
+	// expired 1s ago, inside the 10s window
+	clock.Advance(3 * time.Second)
+	v, info, err := get("out")
+	if !g2cache.IsStale(err) || !errors.Is(err, down) || v != "out value" || !info.Stale || info.Tier != g2cache.TierOut {
+		t.Fatalf("out storage got %q, %+v, %v, want the stale value", v, info, err)
+	}
+	v, info, err = get("local", g2cache.WithLocalOnly())
+	if !g2cache.IsStale(err) || v != "local value" || !info.Stale || info.Tier != g2cache.TierLocal {
+		t.Fatalf("local storage got %q, %+v, %v, want the stale value", v, info, err)
+	}
+
+	// past the window the loader error is returned
+	clock.Advance(10 * time.Second)
+	for _, key := range []string{"out", "local"} {
+		_, info, err = get(key)
+		if g2cache.IsStale(err) || !errors.Is(err, down) || info.Stale {
+			t.Fatalf("%s got %+v, %v after the window, want %v", key, info, err, down)
+		}
+	}
+}
+
+var errOutDown = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+// flakyOut fails every call with a network error while down, and records what it published
+type flakyOut struct {
+	*g2cachetest.MemOutCache
+	down      int32
+	stop      chan struct{}
+	mu        sync.Mutex
+	published []string
+}
+
+func newFlakyOut() *flakyOut {
+	return &flakyOut{MemOutCache: g2cachetest.NewMemOutCache(), stop: make(chan struct{})}
+}
+
+func (f *flakyOut) err() error {
+	if atomic.LoadInt32(&f.down) == 1 {
+		return errOutDown
+	}
+	return nil
+}
+
+func (f *flakyOut) Get(key string, obj interface{}) (*g2cache.Entry, bool, error) {
+	if err := f.err(); err != nil {
+		return nil, false, err
+	}
+	return f.MemOutCache.Get(key, obj)
+}
+
+func (f *flakyOut) Set(key string, e *g2cache.Entry) error {
+	if err := f.err(); err != nil {
+		return err
+	}
+	return f.MemOutCache.Set(key, e)
+}
+
+func (f *flakyOut) Del(key string) error {
+	if err := f.err(); err != nil {
+		return err
+	}
+	return f.MemOutCache.Del(key)
+}
+
+func (f *flakyOut) Subscribe(ch chan<- *g2cache.ChannelMeta) error {
+	<-f.stop
+	return g2cache.OutStorageClose
+}
+
+func (f *flakyOut) Publish(gid, key string, action int8, data *g2cache.Entry) error {
+	if err := f.err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.published = append(f.published, fmt.Sprint(action, ":", key))
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *flakyOut) Published() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.published...)
+}
+
+func (f *flakyOut) Close() {
+	close(f.stop)
+}
+
+// pingOut lets the breaker probe the out storage instead of trying a real request
+type pingOut struct {
+	*flakyOut
+}
+
+func (p pingOut) Ping() error {
+	return p.err()
+}
+
+// waitFor polls cond, background jobs of the cache run asynchronously
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// openBreaker takes the out storage down and fails reads until the breaker opens
+func openBreaker(t *testing.T, g *g2cache.G2Cache, out *flakyOut) {
+	t.Helper()
+	atomic.StoreInt32(&out.down, 1)
+	for i := 0; i < g2cache.OutCacheBreakerThreshold; i++ {
+		var v string
+		if _, err := g.Peek(fmt.Sprint("miss:", i), &v); !errors.Is(err, errOutDown) {
+			t.Fatalf("peek with out storage down returned %v", err)
+		}
+	}
+	if state := g.OutBreakerState(); state != g2cache.BreakerOpen {
+		t.Fatalf("breaker state %d, want open", state)
+	}
+}
+
+func TestOutBreakerProbeReplay(t *testing.T) {
+	defer func(pubsub bool, pending int) {
+		g2cache.OutCachePubSub, g2cache.OutCacheBreakerPendingDel = pubsub, pending
+	}(g2cache.OutCachePubSub, g2cache.OutCacheBreakerPendingDel)
+	g2cache.OutCachePubSub = true
+	g2cache.OutCacheBreakerPendingDel = 2
+
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	out := newFlakyOut()
+	g, err := g2cache.New(pingOut{out}, g2cache.NewFreeCache(), g2cache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := g.Set(key, "old", time.Hour, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	openBreaker(t, g, out)
+
+	// writes succeed locally, out storage deletes are queued up to the cap
+	if err := g.Set("a", "new", time.Hour, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Del("b", true); err != nil {
+		t.Fatal(err)
+	}
+	drops := atomic.LoadInt64(&g2cache.HitStatisticsOut.OutWriteDropTotal)
+	if err := g.Del("c", true); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&g2cache.HitStatisticsOut.OutWriteDropTotal) - drops; n != 1 {
+		t.Fatalf("%d writes dropped over the pending cap, want 1", n)
+	}
+	var v string
+	if ok, err := g.Peek("a", &v); err != nil || !ok || v != "new" {
+		t.Fatalf("local value while open got %q, %v, %v", v, ok, err)
+	}
+
+	// the probe closes the breaker once the out storage answers, then replays and publishes the deletes
+	atomic.StoreInt32(&out.down, 0)
+	waitFor(t, "breaker close", func() bool {
+		clock.Advance(time.Duration(g2cache.OutCacheBreakerProbeSecond) * time.Second)
+		return g.OutBreakerState() == g2cache.BreakerClosed
+	})
+	del := fmt.Sprint(g2cache.DelPublishType, ":")
+	waitFor(t, "replayed deletes", func() bool {
+		published := strings.Join(out.Published(), " ")
+		return strings.Contains(published, del+"a") && strings.Contains(published, del+"b")
+	})
+	for key, want := range map[string]bool{"a": false, "b": false, "c": true} {
+		if _, ok, _ := out.MemOutCache.Get(key, new(string)); ok != want {
+			t.Fatalf("out storage has %s %v after replay, want %v", key, ok, want)
+		}
+	}
+}
+
+func TestOutBreakerHalfOpen(t *testing.T) {
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	out := newFlakyOut()
+	g, err := g2cache.New(out, g2cache.NewFreeCache(), g2cache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	openBreaker(t, g, out)
+	if err := g.Del("a", true); err != nil {
+		t.Fatal(err)
+	}
+
+	halfOpen := func() {
+		t.Helper()
+		waitFor(t, "breaker half open", func() bool {
+			clock.Advance(time.Duration(g2cache.OutCacheBreakerProbeSecond) * time.Second)
+			return g.OutBreakerState() == g2cache.BreakerHalfOpen
+		})
+	}
+	// without a Pinger a single request is let through, a failure opens the breaker again
+	halfOpen()
+	var v string
+	if _, err := g.Peek("x", &v); !errors.Is(err, errOutDown) {
+		t.Fatalf("trial request returned %v", err)
+	}
+	if _, err := g.Peek("x", &v); err != nil {
+		t.Fatalf("request after a failed trial returned %v, want the out storage skipped", err)
+	}
+	if state := g.OutBreakerState(); state != g2cache.BreakerOpen {
+		t.Fatalf("breaker state %d after a failed trial, want open", state)
+	}
+
+	// a successful trial closes it and replays the queued delete
+	if err := out.MemOutCache.Set("a", g2cache.NewEntry("stale", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&out.down, 0)
+	halfOpen()
+	if _, err := g.Peek("x", &v); err != nil {
+		t.Fatal(err)
+	}
+	if state := g.OutBreakerState(); state != g2cache.BreakerClosed {
+		t.Fatalf("breaker state %d after a successful trial, want closed", state)
+	}
+	waitFor(t, "replayed delete", func() bool {
+		_, ok, _ := out.MemOutCache.Get("a", new(string))
+		return !ok
+	})
+}
+
+func TestAsyncWritesKeepOrder(t *testing.T) {
+	out := g2cachetest.NewMemOutCache()
+	g, err := g2cache.New(out, g2cache.NewFreeCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := g.Set("order", i, time.Minute, false); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 0 {
+			if err := g.Del("order", false); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := g.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	if _, ok, err := out.Get("order", &v); err != nil || !ok || v != 99 {
+		t.Fatalf("out storage got %d, %v, %v after async writes, want the last one", v, ok, err)
+	}
+}
+
+// batchOut implements g2cache.BatchOutCache and records the size of each batch
+type batchOut struct {
+	*g2cachetest.MemOutCache
+	fail    int32 // 1 fails every batch
+	mu      sync.Mutex
+	batches []int
+}
+
+func (b *batchOut) Batch(metas []*g2cache.ChannelMeta) error {
+	b.mu.Lock()
+	b.batches = append(b.batches, len(metas))
+	b.mu.Unlock()
+	if atomic.LoadInt32(&b.fail) == 1 {
+		return errOutDown
+	}
+	for _, meta := range metas {
+		if meta.Action == g2cache.DelPublishType {
+			b.Del(meta.Key)
+			continue
+		}
+		if err := b.Set(meta.Key, meta.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *batchOut) Batches() []int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]int(nil), b.batches...)
+}
+
+func TestWriteBatchCoalesce(t *testing.T) {
+	defer func(delay int) {
+		g2cache.AsyncWriteBatchDelayMs = delay
+	}(g2cache.AsyncWriteBatchDelayMs)
+	g2cache.AsyncWriteBatchDelayMs = 10
+
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	out := &batchOut{MemOutCache: g2cachetest.NewMemOutCache()}
+	g, err := g2cache.New(out, g2cache.NewFreeCache(), g2cache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	flush := func(batches int) {
+		t.Helper()
+		waitFor(t, "batch flush", func() bool {
+			clock.Advance(10 * time.Millisecond)
+			return len(out.Batches()) >= batches
+		})
+	}
+
+	// writes of the same key within the window collapse into the last one
+	for i := 0; i < 5; i++ {
+		if err := g.Set("k", i, time.Minute, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Set("j", 1, time.Minute, false); err != nil {
+		t.Fatal(err)
+	}
+	flush(1)
+	if batches := out.Batches(); len(batches) != 1 || batches[0] != 2 {
+		t.Fatalf("batches %v, want one of 2 keys", batches)
+	}
+	var v int
+	if _, ok, err := out.Get("k", &v); err != nil || !ok || v != 4 {
+		t.Fatalf("out storage got %d, %v, %v, want the last write", v, ok, err)
+	}
+
+	// a failed batch is retried key by key
+	atomic.StoreInt32(&out.fail, 1)
+	if err := g.Set("f", 7, time.Minute, false); err != nil {
+		t.Fatal(err)
+	}
+	flush(2)
+	waitFor(t, "key by key retry", func() bool {
+		_, ok, _ := out.Get("f", &v)
+		return ok && v == 7
+	})
+}
+
+// slowOut takes 20ms per write and counts them
+type slowOut struct {
+	*g2cachetest.MemOutCache
+	sets int64
+}
+
+func (s *slowOut) Set(key string, e *g2cache.Entry) error {
+	time.Sleep(20 * time.Millisecond)
+	atomic.AddInt64(&s.sets, 1)
+	return s.MemOutCache.Set(key, e)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	// key lanes: the writes not applied by the deadline are reported as dropped
+	out := &slowOut{MemOutCache: g2cachetest.NewMemOutCache()}
+	g, err := g2cache.New(out, g2cache.NewFreeCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 10
+	for i := 0; i < n; i++ {
+		if err := g.Set("slow", i, time.Minute, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	dropped, err := g.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || dropped == 0 {
+		t.Fatalf("shutdown return %d, %v, want writes dropped at the deadline", dropped, err)
+	}
+	waitFor(t, "the write in hand", func() bool {
+		return int(atomic.LoadInt64(&out.sets))+dropped == n
+	})
+
+	// write batches: nothing is flushed once ctx is done
+	defer func(delay int) {
+		g2cache.AsyncWriteBatchDelayMs = delay
+	}(g2cache.AsyncWriteBatchDelayMs)
+	g2cache.AsyncWriteBatchDelayMs = 10
+	for _, cancelled := range []bool{true, false} {
+		out := g2cachetest.NewMemOutCache()
+		g, err := g2cache.New(out, g2cache.NewFreeCache(), g2cache.WithClock(g2cachetest.NewFakeClock(time.Unix(1600000000, 0))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if err := g.Set(fmt.Sprint("batch:", i), i, time.Minute, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if cancelled {
+			cancel()
+		}
+		dropped, _ := g.Shutdown(ctx)
+		cancel()
+		if cancelled && (dropped != 3 || out.Len() != 0) {
+			t.Fatalf("cancelled shutdown dropped %d, out storage has %d keys, want 3 dropped", dropped, out.Len())
+		}
+		if !cancelled && (dropped != 0 || out.Len() != 3) {
+			t.Fatalf("shutdown dropped %d, out storage has %d keys, want 3 flushed", dropped, out.Len())
+		}
+	}
+}
+
+func TestShutdownWaitsForRefresh(t *testing.T) {
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	out := g2cachetest.NewMemOutCache()
+	g, err := g2cache.New(out, g2cache.NewFreeCache(), g2cache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Set("refresh", 1, 10500*time.Millisecond, true, g2cache.WithLocalOnly(), g2cache.WithHardTTL(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10600 * time.Millisecond)
+
+	// the obsolete local value is served, the refresh job is still loading when Shutdown starts
+	started, gate := make(chan struct{}), make(chan struct{})
+	var v int
+	info, err := g.GetWithInfo("refresh", time.Minute, &v, func() (interface{}, error) {
+		close(started)
+		<-gate
+		return 2, nil
+	})
+	if err != nil || v != 1 || !info.RefreshScheduled {
+		t.Fatalf("got %d, %+v, %v, want the obsolete value", v, info, err)
+	}
+	<-started
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if dropped, err := g.Shutdown(context.Background()); dropped != 0 || err != nil {
+			t.Errorf("shutdown return %d, %v", dropped, err)
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(gate)
+	<-done
+	if _, ok, err := out.Get("refresh", &v); err != nil || !ok || v != 2 {
+		t.Fatalf("out storage got %d, %v, %v, want the refreshed value", v, ok, err)
+	}
+}
+
+// recordLogger keeps the structured records
+type recordLogger struct {
+	mu      sync.Mutex
+	records []string
+}
+
+func (r *recordLogger) Log(level g2cache.LogLevel, msg string, fields ...g2cache.LogField) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec := level.String() + " " + msg
+	for _, f := range fields {
+		rec += fmt.Sprint(" ", f.Key, "=", f.Value)
+	}
+	r.records = append(r.records, rec)
+}
+
+func (r *recordLogger) Records() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.records...)
+}
+
+func TestLogErrRateLimit(t *testing.T) {
+	rec := &recordLogger{}
+	defer func(l g2cache.StructuredLogger, second, burst int) {
+		g2cache.StructLogger, g2cache.LogErrRateLimitSecond, g2cache.LogErrRateLimitBurst = l, second, burst
+	}(g2cache.StructLogger, g2cache.LogErrRateLimitSecond, g2cache.LogErrRateLimitBurst)
+	g2cache.StructLogger, g2cache.LogErrRateLimitSecond, g2cache.LogErrRateLimitBurst = rec, 1, 2
+	// windows are whole unix seconds, the fake clock starts at the beginning of one
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	g2cache.SetLogClock(clock)
+	defer g2cache.SetLogClock(nil)
+
+	// errors are limited per msg, debug records are not limited
+	for i := 0; i < 5; i++ {
+		g2cache.LogErrW("rate limit test", g2cache.Field("i", i))
+		g2cache.LogErrW("rate limit test other")
+		g2cache.LogDebugW("rate limit test debug")
+	}
+	want := []string{
+		"err rate limit test i=0", "err rate limit test other", "debug rate limit test debug",
+		"err rate limit test i=1", "err rate limit test other", "debug rate limit test debug",
+		"debug rate limit test debug", "debug rate limit test debug", "debug rate limit test debug",
+	}
+	if got := rec.Records(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got records %q, want %q", got, want)
+	}
+
+	// the next window reports how many were suppressed
+	clock.Advance(time.Second)
+	g2cache.LogErrW("rate limit test", g2cache.Field("i", 5))
+	if got := rec.Records(); got[len(got)-1] != "err rate limit test i=5 suppressed=3" {
+		t.Fatalf("got record %q, want the suppressed count", got[len(got)-1])
+	}
+}
+
+func TestLogWarnLevel(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(l g2cache.StructuredLogger, color bool, flags int) {
+		g2cache.StructLogger, g2cache.LogColor = l, color
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}(g2cache.StructLogger, g2cache.LogColor, log.Flags())
+	g2cache.StructLogger, g2cache.LogColor = nil, false
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	g2cache.SetLogClock(nil) // new rate limit windows, so reruns are not suppressed
+
+	// the default Logger prints warn records as warn, not as err
+	g2cache.LogWarnW("warn level test", g2cache.Field("n", 1))
+	if got := buf.String(); got != "[g2cache] [warn]  warn level test n=1\n" {
+		t.Fatalf("got %q, want a warn record", got)
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := g2cache.NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	l.Log(g2cache.LogLevelError, "slog test", g2cache.FieldKey("k"), g2cache.FieldTier(g2cache.TierOut), g2cache.FieldErr(errors.New("boom")), g2cache.Field("n", 3))
+	l.Log(g2cache.LogLevelDebug, "slog test debug")
+
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("want a single record below the handler level, got %q: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"level":  "ERROR",
+		"msg":    "slog test",
+		"logger": "g2cache",
+		"key":    "k",
+		"tier":   "out",
+		"error":  "boom",
+		"n":      float64(3),
+	}
+	for k, v := range want {
+		if rec[k] != v {
+			t.Fatalf("record %s = %v, want %v in %s", k, rec[k], v, buf.String())
+		}
+	}
+}
+
+// recordListener keeps the events it receives, gate blocks every callback until closed
+type recordListener struct {
+	g2cache.NopListener
+	gate   chan struct{}
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recordListener) record(ev string) {
+	if r.gate != nil {
+		<-r.gate
+	}
+	r.mu.Lock()
+	r.events = append(r.events, ev)
+	r.mu.Unlock()
+}
+
+func (r *recordListener) OnLocalHit(key string) { r.record("local_hit:" + key) }
+func (r *recordListener) OnOutHit(key string)   { r.record("out_hit:" + key) }
+func (r *recordListener) OnLoad(key string, d time.Duration, err error) {
+	r.record(fmt.Sprint("load:", key, " ", d, " ", err != nil))
+}
+func (r *recordListener) OnStaleRefresh(key string) { r.record("stale_refresh:" + key) }
+
+func (r *recordListener) Events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func TestListenerEvents(t *testing.T) {
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache(), g2cache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	l := &recordListener{}
+	g.AddListener(l)
+
+	var v int
+	load := func() (interface{}, error) {
+		clock.Advance(250 * time.Millisecond)
+		return 1, nil
+	}
+	if err := g.Get("listen", time.Minute, &v, load); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Get("listen", time.Minute, &v, load); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Get("listen:err", time.Minute, &v, func() (interface{}, error) {
+		return nil, errors.New("source down")
+	}); err == nil {
+		t.Fatal("want the load error")
+	}
+	if err := g.Set("listen:refresh", 1, 10500*time.Millisecond, true, g2cache.WithLocalOnly(), g2cache.WithHardTTL(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10600 * time.Millisecond)
+	if err := g.Get("listen:refresh", time.Minute, &v, load); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"load:listen 250ms false",
+		"local_hit:listen",
+		"load:listen:err 0s true",
+		"local_hit:listen:refresh",
+		"stale_refresh:listen:refresh",
+	}
+	waitFor(t, "listener events", func() bool {
+		return len(l.Events()) >= len(want)
+	})
+	if got := l.Events(); fmt.Sprint(got[:len(want)]) != fmt.Sprint(want) {
+		t.Fatalf("got events %q, want %q", got, want)
+	}
+}
+
+func TestListenerDropsWhenBehind(t *testing.T) {
+	defer func(n int) {
+		g2cache.ListenerEventQueueLen = n
+	}(g2cache.ListenerEventQueueLen)
+	g2cache.ListenerEventQueueLen = 2
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	l := &recordListener{gate: make(chan struct{})}
+	g.AddListener(l)
+
+	// the listener is stuck, at most one event in hand and two queued are kept
+	dropped := atomic.LoadInt64(&g2cache.HitStatisticsOut.EventDropTotal)
+	var v int
+	for i := 0; i < 10; i++ {
+		if err := g.Get("behind", time.Minute, &v, func() (interface{}, error) {
+			return 1, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt64(&g2cache.HitStatisticsOut.EventDropTotal) - dropped; n < 7 {
+		t.Fatalf("dropped %d events, want at least 7", n)
+	}
+	close(l.gate)
+	waitFor(t, "queued events", func() bool {
+		return len(l.Events()) >= 2
+	})
+	if n := len(l.Events()); n > 3 {
+		t.Fatalf("listener got %d events, want at most 3", n)
+	}
+}
+
+func TestGetWithInfoTier(t *testing.T) {
+	out := g2cachetest.NewMemOutCache()
+	a, err := g2cache.New(out, g2cache.NewFreeCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := g2cache.New(out, g2cache.NewFreeCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	var loads int64
+	load := func() (interface{}, error) {
+		atomic.AddInt64(&loads, 1)
+		time.Sleep(20 * time.Millisecond)
+		return 1, nil
+	}
+	get := func(g *g2cache.G2Cache, wantTier string) *g2cache.GetInfo {
+		t.Helper()
+		var v int
+		info, err := g.GetWithInfo("info", time.Minute, &v, load)
+		if err != nil || v != 1 {
+			t.Fatalf("got %d, %v", v, err)
+		}
+		if info.Tier != wantTier || info.Stale || info.RefreshScheduled {
+			t.Fatalf("got %+v, want a fresh value from %s", info, wantTier)
+		}
+		if info.ObsoleteTTL <= 0 || info.ObsoleteTTL > time.Minute || info.ExpireTTL < info.ObsoleteTTL {
+			t.Fatalf("got obsolete ttl %v, expire ttl %v", info.ObsoleteTTL, info.ExpireTTL)
+		}
+		return info
+	}
+
+	// a load reports the time spent in the data source, cache hits do not
+	if info := get(a, g2cache.TierSource); info.LoadDuration < 20*time.Millisecond {
+		t.Fatalf("load duration %v, want the loader time", info.LoadDuration)
+	}
+	waitFor(t, "out write", func() bool {
+		return out.Len() == 1
+	})
+	if info := get(b, g2cache.TierOut); info.LoadDuration != 0 {
+		t.Fatalf("out hit load duration %v", info.LoadDuration)
+	}
+	if info := get(b, g2cache.TierLocal); info.LoadDuration != 0 {
+		t.Fatalf("local hit load duration %v", info.LoadDuration)
+	}
+	if info := get(a, g2cache.TierLocal); info.LoadDuration != 0 {
+		t.Fatalf("local hit load duration %v", info.LoadDuration)
+	}
+	if n := atomic.LoadInt64(&loads); n != 1 {
+		t.Fatalf("loaded %d times, want 1", n)
+	}
+}
+
+func TestCallOptions(t *testing.T) {
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	out := newFlakyOut()
+	out.SetClock(clock)
+	g, err := g2cache.New(out, g2cache.NewFreeCache(), g2cache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	var loads int64
+	load := func() (interface{}, error) {
+		return int(atomic.AddInt64(&loads, 1)), nil
+	}
+	get := func(key string, opts ...g2cache.CallOption) (int, *g2cache.GetInfo) {
+		t.Helper()
+		var v int
+		info, err := g.GetWithInfo(key, time.Minute, &v, load, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v, info
+	}
+
+	// per-call stale and hard TTLs replace ttl and EntryLazyFactor, on Set and on load
+	if err := g.Set("ttl", 1, time.Minute, true, g2cache.WithStaleTTL(5*time.Second), g2cache.WithHardTTL(30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, info := get("ttl"); info.ObsoleteTTL != 5*time.Second || info.ExpireTTL != 30*time.Second {
+		t.Fatalf("set ttl got %+v", info)
+	}
+	if _, info := get("ttl:load", g2cache.WithStaleTTL(5*time.Second), g2cache.WithHardTTL(30*time.Second)); info.Tier != g2cache.TierSource {
+		t.Fatalf("got %+v, want a load", info)
+	}
+	var v int
+	waitFor(t, "out write", func() bool {
+		_, ok, _ := out.Get("ttl:load", &v)
+		return ok
+	})
+	if e, ok, err := out.Get("ttl:load", &v); err != nil || !ok || e.ObsoleteTTLAt(clock.Now()) != 5*time.Second || e.ExpireTTLAt(clock.Now()) != 30*time.Second {
+		t.Fatalf("out storage got %+v, %v, %v, want the per-call ttls", e, ok, err)
+	}
+
+	// force refresh reloads a cached value
+	if v, info := get("ttl:load", g2cache.WithForceRefresh()); v != 2 || info.Tier != g2cache.TierSource {
+		t.Fatalf("force refresh got %d, %+v", v, info)
+	}
+	if v, info := get("ttl:load"); v != 2 || info.Tier != g2cache.TierLocal {
+		t.Fatalf("got %d, %+v, want the refreshed value", v, info)
+	}
+
+	// local only neither writes nor publishes to the out storage
+	if err := g.Set("local", 1, time.Minute, true, g2cache.WithLocalOnly()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := out.Get("local", &v); ok {
+		t.Fatal("local only value written to the out storage")
+	}
+	if _, info := get("local", g2cache.WithLocalOnly()); info.Tier != g2cache.TierLocal {
+		t.Fatalf("got %+v", info)
+	}
+
+	// out only skips the local storage
+	if err := g.Set("out", 1, time.Minute, true, g2cache.WithOutOnly()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, info := get("out", g2cache.WithOutOnly()); info.Tier != g2cache.TierOut {
+			t.Fatalf("got %+v, want an out hit", info)
+		}
+	}
+
+	// no publish writes the out storage without telling other instances
+	if err := g.Set("quiet", 1, time.Minute, true, g2cache.WithNoPublish()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := out.Get("quiet", &v); !ok {
+		t.Fatal("no publish value not written to the out storage")
+	}
+	for _, p := range out.Published() {
+		if strings.HasSuffix(p, ":quiet") || strings.HasSuffix(p, ":local") {
+			t.Fatalf("published %s", p)
+		}
+	}
+}
+
+func TestCallLoaderOptions(t *testing.T) {
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache(),
+		g2cache.WithDefaultLoaderRetry(2, time.Millisecond), g2cache.WithDefaultLoaderTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	var calls int64
+	failing := func() (interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		return nil, g2cache.Retryable(errors.New("source busy"))
+	}
+	var v int
+	// the instance default retries twice, a per-call override disables retries
+	for _, tt := range []struct {
+		opts  []g2cache.CallOption
+		calls int64
+	}{
+		{nil, 3},
+		{[]g2cache.CallOption{g2cache.WithLoaderRetry(0, 0)}, 1},
+		{[]g2cache.CallOption{g2cache.WithLoaderRetry(4, time.Millisecond)}, 5},
+	} {
+		atomic.StoreInt64(&calls, 0)
+		if err := g.Get("retry", time.Minute, &v, failing, tt.opts...); err == nil {
+			t.Fatal("want the load error")
+		}
+		if n := atomic.LoadInt64(&calls); n != tt.calls {
+			t.Fatalf("loader called %d times, want %d", n, tt.calls)
+		}
+	}
+
+	// a per-call timeout shorter than the instance default
+	gate := make(chan struct{})
+	defer close(gate)
+	start := time.Now()
+	err = g.Get("timeout", time.Minute, &v, func() (interface{}, error) {
+		<-gate
+		return 1, nil
+	}, g2cache.WithLoaderTimeout(20*time.Millisecond), g2cache.WithLoaderRetry(0, 0))
+	if !errors.Is(err, g2cache.DataSourceLoadTimeout) || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("got %v after %v, want the per-call timeout", err, time.Since(start))
+	}
+}
+
+func TestEntryLegacyFormat(t *testing.T) {
+	type value struct {
+		A int `json:"a"`
+	}
+	// written by versions with second precision
+	var v value
+	e := &g2cache.Entry{Value: &v}
+	if err := json.Unmarshal([]byte(`{"value":{"a":1},"ttl":60,"obsolete":1600000060,"expiration":1600001920}`), e); err != nil {
+		t.Fatal(err)
+	}
+	if v.A != 1 || e.Ttl != time.Minute || e.Obsolete != 1600000060000 || e.Expiration != 1600001920000 {
+		t.Fatalf("decoded %+v, value %+v", e, v)
+	}
+
+	// read back by both versions
+	now := time.Unix(1600000000, 0)
+	b, err := json.Marshal(g2cache.NewEntryAt(value{A: 2}, 1500*time.Millisecond, time.Minute, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var legacy struct {
+		Value      value `json:"value"`
+		TtlSecond  int   `json:"ttl"`
+		Obsolete   int64 `json:"obsolete"`
+		Expiration int64 `json:"expiration"`
+	}
+	if err := json.Unmarshal(b, &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if legacy.Value.A != 2 || legacy.TtlSecond != 1 || legacy.Obsolete != 1600000001 || legacy.Expiration != 1600000060 {
+		t.Fatalf("legacy reader decoded %+v from %s", legacy, b)
+	}
+	v = value{}
+	e = &g2cache.Entry{Value: &v}
+	if err := json.Unmarshal(b, e); err != nil {
+		t.Fatal(err)
+	}
+	if v.A != 2 || e.Ttl != 1500*time.Millisecond || e.Obsolete != 1600000001500 || e.Expiration != 1600000060000 {
+		t.Fatalf("decoded %+v, value %+v from %s", e, v, b)
+	}
+}
+
+func TestUpdateConcurrent(t *testing.T) {
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var v int
+			err := g.Update("counter", time.Minute, &v, func(old interface{}) (interface{}, error) {
+				if old == nil {
+					return 1, nil
+				}
+				return *old.(*int) + 1, nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var v int
+	err = g.Get("counter", time.Minute, &v, func() (interface{}, error) {
+		return nil, errors.New("counter not cached")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != n {
+		t.Fatalf("counter is %d, want %d", v, n)
+	}
+}
+
+func TestUpdateConflict(t *testing.T) {
+	out := g2cachetest.NewMemOutCache()
+	g, err := g2cache.New(out, g2cache.NewFreeCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	// another writer changes the key between read and commit, twice
+	var writes int64
+	out.BeforeCommit = func(key string) {
+		if atomic.AddInt64(&writes, 1) <= 2 {
+			out.Set(key, g2cache.NewEntry(100, time.Minute))
+		}
+	}
+	var calls int64
+	incr := func(old interface{}) (interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		if old == nil {
+			return 1, nil
+		}
+		return *old.(*int) + 1, nil
+	}
+	var v int
+	if err := g.Update("cas", time.Minute, &v, incr); err != nil {
+		t.Fatal(err)
+	}
+	if v != 101 || atomic.LoadInt64(&calls) != 3 {
+		t.Fatalf("got %d after %d calls, want 101 after 3", v, calls)
+	}
+
+	// a writer that always wins
+	out.BeforeCommit = func(key string) {
+		out.Set(key, g2cache.NewEntry(100, time.Minute))
+	}
+	atomic.StoreInt64(&calls, 0)
+	err = g.Update("cas", time.Minute, &v, incr)
+	if !errors.Is(err, g2cache.UpdateConflict) || atomic.LoadInt64(&calls) != int64(g2cache.UpdateMaxRetry) {
+		t.Fatalf("got %v after %d calls, want UpdateConflict after %d", err, calls, g2cache.UpdateMaxRetry)
+	}
+}
+
+func TestUpdateAfterAsyncSet(t *testing.T) {
+	out := &slowOut{MemOutCache: g2cachetest.NewMemOutCache()}
+	g, err := g2cache.New(out, g2cache.NewFreeCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	// the async write is still in flight when Update starts, the update must see it
+	if err := g.Set("lane", 1, time.Minute, false); err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	err = g.Update("lane", time.Minute, &v, func(old interface{}) (interface{}, error) {
+		if old == nil {
+			return 0, nil
+		}
+		return *old.(*int) + 1, nil
+	})
+	if err != nil || v != 2 {
+		t.Fatalf("got %d, %v, want the update applied after the async set", v, err)
+	}
+}
+
+func TestUpdateAfterBatchedSet(t *testing.T) {
+	defer func(delay int) {
+		g2cache.AsyncWriteBatchDelayMs = delay
+	}(g2cache.AsyncWriteBatchDelayMs)
+	g2cache.AsyncWriteBatchDelayMs = 10
+
+	// the fake clock is never advanced, so the batched writes stay pending until Update flushes them
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache(), g2cache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	incr := func(old interface{}) (interface{}, error) {
+		if old == nil {
+			return 0, nil
+		}
+		return *old.(*int) + 1, nil
+	}
+	check := func(key string, want int) {
+		t.Helper()
+		for _, opt := range []g2cache.CallOption{g2cache.WithLocalOnly(), g2cache.WithOutOnly()} {
+			var v int
+			if ok, err := g.Peek(key, &v, opt); !ok || err != nil || v != want {
+				t.Fatalf("%s got %d, %v, %v, want %d in both storages", key, v, ok, err, want)
+			}
+		}
+	}
+
+	if err := g.Set("batch", 1, time.Minute, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Set("batch", 5, time.Minute, false); err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	if err := g.Update("batch", time.Minute, &v, incr); err != nil || v != 6 {
+		t.Fatalf("got %d, %v, want the update applied after the batched set", v, err)
+	}
+	check("batch", 6)
+
+	// a batched delete is not undone by the update
+	if err := g.Set("batch:del", 1, time.Minute, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Del("batch:del", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Update("batch:del", time.Minute, &v, incr); err != nil || v != 0 {
+		t.Fatalf("got %d, %v, want the update applied after the batched del", v, err)
+	}
+	check("batch:del", 0)
+}
+
+func TestCounterLocalAggregation(t *testing.T) {
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	out := g2cachetest.NewMemOutCache()
+	g, err := g2cache.New(out, g2cache.NewFreeCache(), g2cache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := g.Incr("views", 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Decr("views", 1); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := out.GetCounter("views"); v != 0 {
+		t.Fatalf("out storage counter is %d before flush, want 0", v)
+	}
+	if v, err := g.Counter("views", time.Second); err != nil || v != 5 {
+		t.Fatalf("counter is %d, %v, want 5", v, err)
+	}
+
+	if _, err := g.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := out.GetCounter("views"); v != 5 {
+		t.Fatalf("out storage counter is %d after shutdown, want 5", v)
+	}
+}
+
+// failingCounterOut fails IncrBy while down
+type failingCounterOut struct {
+	*g2cachetest.MemOutCache
+	down int32
+}
+
+func (f *failingCounterOut) IncrBy(key string, delta int64) (int64, error) {
+	if atomic.LoadInt32(&f.down) == 1 {
+		return 0, errOutDown
+	}
+	return f.MemOutCache.IncrBy(key, delta)
+}
+
+func TestCounterShutdownFlushFailed(t *testing.T) {
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	out := &failingCounterOut{MemOutCache: g2cachetest.NewMemOutCache(), down: 1}
+	g, err := g2cache.New(out, g2cache.NewFreeCache(), g2cache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"views:a", "views:b"} {
+		if err := g.Incr(key, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the increments that fail to flush on shutdown are lost, and reported
+	dropped, err := g.Shutdown(context.Background())
+	if err != nil || dropped != 2 {
+		t.Fatalf("shutdown return %d, %v, want 2 dropped", dropped, err)
+	}
+}
+
+func TestCounterValuesPruned(t *testing.T) {
+	defer func(ms int) {
+		g2cache.CounterFlushMs = ms
+	}(g2cache.CounterFlushMs)
+	g2cache.CounterFlushMs = 0
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	out := g2cachetest.NewMemOutCache()
+	g, err := g2cache.New(out, g2cache.NewFreeCache(), g2cache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if err := g.Incr("pruned", 1); err != nil {
+		t.Fatal(err)
+	}
+	out.IncrBy("pruned", 10) // another instance
+	if v, err := g.Counter("pruned", time.Hour); err != nil || v != 1 {
+		t.Fatalf("counter is %d, %v, want the value read back by Incr", v, err)
+	}
+	// the value read back is forgotten after CounterValueKeepMs, and read again
+	clock.Advance(time.Duration(g2cache.CounterValueKeepMs)*time.Millisecond + time.Second)
+	if err := g.Incr("other", 1); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := g.Counter("pruned", time.Hour); err != nil || v != 11 {
+		t.Fatalf("counter is %d, %v, want 11 read from out storage", v, err)
+	}
+}
+
+func TestTouchKeepsValue(t *testing.T) {
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache(), g2cache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	type user struct {
+		ID   int64
+		Name string
+	}
+	want := user{ID: 1<<60 + 1, Name: "g2cache"}
+	if err := g.Set("user", &want, 10*time.Second, true, g2cache.WithHardTTL(20*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(15 * time.Second)
+	if err := g.Touch("user", time.Minute, g2cache.WithHardTTL(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+
+	info, err := g.TTL("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Out.Found || info.Out.ExpireTTL != time.Hour-time.Minute {
+		t.Fatalf("out storage ttl %+v, want expire in %v", info.Out, time.Hour-time.Minute)
+	}
+	var got user
+	err = g.Get("user", time.Minute, &got, func() (interface{}, error) {
+		return nil, errors.New("user not cached")
+	})
+	if err != nil || got != want {
+		t.Fatalf("got %+v, %v, want %+v", got, err, want)
+	}
+	if err := g.Touch("missing", time.Minute); err != g2cache.CacheKeyNotFound {
+		t.Fatalf("touch missing key return %v, want %v", err, g2cache.CacheKeyNotFound)
+	}
+}
+
+func TestTouchAfterAsyncSet(t *testing.T) {
+	out := &slowOut{MemOutCache: g2cachetest.NewMemOutCache()}
+	g, err := g2cache.New(out, g2cache.NewFreeCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	// the async write is still in flight when Touch starts, it must not overwrite the renewed ttl afterwards
+	if err := g.Set("lane", 1, time.Minute, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Touch("lane", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	info, err := g.TTL("lane")
+	if err != nil || !info.Out.Found || info.Out.ObsoleteTTL < 59*time.Minute {
+		t.Fatalf("got %+v, %v, want the out storage ttl renewed", info, err)
+	}
+}
+
+func TestTouchAfterBatchedSet(t *testing.T) {
+	defer func(delay int) {
+		g2cache.AsyncWriteBatchDelayMs = delay
+	}(g2cache.AsyncWriteBatchDelayMs)
+	g2cache.AsyncWriteBatchDelayMs = 10
+
+	// the fake clock is never advanced, so the batched writes stay pending until Touch flushes them
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache(), g2cache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if err := g.Set("batch", 1, time.Minute, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Set("batch", 5, time.Minute, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Touch("batch", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range []g2cache.CallOption{g2cache.WithLocalOnly(), g2cache.WithOutOnly()} {
+		var v int
+		if ok, err := g.Peek("batch", &v, opt); !ok || err != nil || v != 5 {
+			t.Fatalf("got %d, %v, %v, want the batched value in both storages", v, ok, err)
+		}
+	}
+	info, err := g.TTL("batch")
+	if err != nil || info.Out.ObsoleteTTL < 59*time.Minute || info.Local.ObsoleteTTL < 59*time.Minute {
+		t.Fatalf("got %+v, %v, want the ttl renewed in both storages", info, err)
+	}
+
+	// a batched delete is not undone by the touch
+	if err := g.Del("batch", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Touch("batch", time.Hour); !errors.Is(err, g2cache.CacheKeyNotFound) {
+		t.Fatalf("touch got %v, want CacheKeyNotFound after the batched del", err)
+	}
+	if local, out, err := g.Exists("batch"); local || out || err != nil {
+		t.Fatalf("exists got %v, %v, %v, want the key deleted", local, out, err)
+	}
+}
+
+func TestPeekExistsReadOnly(t *testing.T) {
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache(), g2cache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	l := &recordListener{}
+	g.AddListener(l)
+
+	// an obsolete value is returned as is, not refreshed
+	if err := g.Set("peek", 1, 10500*time.Millisecond, true, g2cache.WithHardTTL(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10600 * time.Millisecond)
+	var v int
+	if ok, err := g.Peek("peek", &v); !ok || err != nil || v != 1 {
+		t.Fatalf("peek got %d, %v, %v", v, ok, err)
+	}
+
+	// a value from out storage does not fill local storage
+	if err := g.Set("peek:out", 2, time.Minute, true, g2cache.WithOutOnly()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := g.Peek("peek:out", &v); !ok || err != nil || v != 2 {
+		t.Fatalf("peek got %d, %v, %v", v, ok, err)
+	}
+	if local, out, err := g.Exists("peek:out"); local || !out || err != nil {
+		t.Fatalf("exists got %v, %v, %v, want only in out storage", local, out, err)
+	}
+	if local, out, err := g.Exists("peek:missing"); local || out || err != nil {
+		t.Fatalf("exists got %v, %v, %v", local, out, err)
+	}
+	if ok, err := g.Peek("peek:missing", &v); ok || err != nil {
+		t.Fatalf("peek missing key got %v, %v", ok, err)
+	}
+
+	// errors name the tier the value came from
+	if err := g.Set("peek:bad", "not a number", time.Minute, true, g2cache.WithOutOnly()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.Peek("peek:bad", &v)
+	var ce *g2cache.CacheError
+	if !errors.As(err, &ce) || ce.Tier != g2cache.TierOut || ce.Op != g2cache.OpPeek {
+		t.Fatalf("peek got %v, want an out storage error", err)
+	}
+
+	if keys := g.HotKeys(0); len(keys) != 0 {
+		t.Fatalf("peek recorded hot keys %v", keys)
+	}
+	// a Get event marks the end, Peek and Exists emit none
+	if err := g.Get("peek:out", time.Minute, &v, func() (interface{}, error) {
+		return nil, errors.New("peek:out not cached")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "get event", func() bool {
+		return len(l.Events()) > 0
+	})
+	if got := l.Events(); len(got) != 1 {
+		t.Fatalf("got events %q, want only the Get", got)
+	}
+}
+
+func TestKeyFilterRejectsUnknownKeys(t *testing.T) {
+	filter := g2cache.NewBloomFilter(1000, 0.01)
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache(), g2cache.WithKeyFilter(filter, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	for i := 0; i < 1000; i++ {
+		if err := g.Set(fmt.Sprint("user:", i), i, time.Minute, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var loads int
+	load := func() (interface{}, error) {
+		loads++
+		return 1, nil
+	}
+	falsePositive := 0
+	for i := 1000; i < 11000; i++ {
+		var v int
+		err := g.Get(fmt.Sprint("user:", i), time.Minute, &v, load)
+		if err == nil {
+			falsePositive++
+		} else if err != g2cache.CacheKeyNotFound {
+			t.Fatal(err)
+		}
+	}
+	if loads != falsePositive || falsePositive > 300 {
+		t.Fatalf("%d loads, %d false positives out of 10000", loads, falsePositive)
+	}
+	var v int
+	if err := g.Get("user:7", time.Minute, &v, load); err != nil || v != 7 {
+		t.Fatalf("got %d, %v, want 7", v, err)
+	}
+}
+
+// countingFilter counts MayContain calls, like a filter kept in out storage would pay a round trip for each
+type countingFilter struct {
+	g2cache.KeyFilter
+	checks int64
+}
+
+func (f *countingFilter) MayContain(key string) (bool, error) {
+	atomic.AddInt64(&f.checks, 1)
+	return f.KeyFilter.MayContain(key)
+}
+
+func TestKeyFilterOnlyBeforeLoad(t *testing.T) {
+	filter := &countingFilter{KeyFilter: g2cache.NewBloomFilter(1000, 0.01)}
+	out := g2cachetest.NewMemOutCache()
+	g, err := g2cache.New(out, g2cache.NewFreeCache(), g2cache.WithKeyFilter(filter, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	other, err := g2cache.New(out, g2cache.NewFreeCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	// local and out storage hits do not ask the filter
+	if err := g.Set("filter:local", 1, time.Minute, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Set("filter:out", 2, time.Minute, true, g2cache.WithNoPublish()); err != nil {
+		t.Fatal(err)
+	}
+	load := func() (interface{}, error) {
+		return 3, nil
+	}
+	var v int
+	for _, key := range []string{"filter:local", "filter:out", "filter:out"} {
+		if err := g.Get(key, time.Minute, &v, load); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt64(&filter.checks); n != 0 {
+		t.Fatalf("filter asked %d times on cache hits", n)
+	}
+	// a miss in both storages is checked before the load
+	if err := g.Get("filter:missing", time.Minute, &v, load); !errors.Is(err, g2cache.CacheKeyNotFound) {
+		t.Fatalf("got %v, want CacheKeyNotFound", err)
+	}
+	if n := atomic.LoadInt64(&filter.checks); n != 1 {
+		t.Fatalf("filter asked %d times, want 1", n)
+	}
+}
+
+func TestLoaderPanicTimeoutRetry(t *testing.T) {
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache(),
+		g2cache.WithDefaultLoaderTimeout(50*time.Millisecond), g2cache.WithDefaultLoaderRetry(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	var v int
+	err = g.Get("panic", time.Minute, &v, func() (interface{}, error) {
+		panic("boom")
+	})
+	var pe *g2cache.LoaderPanicError
+	if !errors.As(err, &pe) || pe.Value != "boom" {
+		t.Fatalf("panic returned %v, want *LoaderPanicError", err)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	err = g.Get("hang", time.Minute, &v, func() (interface{}, error) {
+		<-release
+		return 1, nil
+	}, g2cache.WithLoaderRetry(0, 0))
+	if !errors.Is(err, g2cache.DataSourceLoadTimeout) {
+		t.Fatalf("hung loader returned %v, want %v", err, g2cache.DataSourceLoadTimeout)
+	}
+
+	calls := 0
+	err = g.Get("flaky", time.Minute, &v, func() (interface{}, error) {
+		calls++
+		if calls < 3 {
+			return nil, g2cache.Retryable(errors.New("connection reset"))
+		}
+		return 3, nil
+	})
+	if err != nil || v != 3 || calls != 3 {
+		t.Fatalf("got %d, %v after %d calls, want 3 after 3 calls", v, err, calls)
+	}
+}
+
+func TestCacheError(t *testing.T) {
+	out := newFlakyOut()
+	g, err := g2cache.New(out, g2cache.NewFreeCache(), g2cache.WithDefaultLoaderTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	var v int
+	for _, tt := range []struct {
+		name      string
+		call      func() error
+		op, tier  string
+		target    error
+		transient bool
+	}{
+		{"loader panic", func() error {
+			return g.Get("panic", time.Minute, &v, func() (interface{}, error) {
+				panic("boom")
+			})
+		}, g2cache.OpGet, g2cache.TierSource, nil, false},
+		{"loader nil", func() error {
+			return g.Get("nil", time.Minute, &v, func() (interface{}, error) {
+				return nil, nil
+			})
+		}, g2cache.OpGet, g2cache.TierSource, g2cache.DataSourceLoadNil, false},
+		{"loader timeout", func() error {
+			return g.Get("hang", time.Minute, &v, func() (interface{}, error) {
+				<-release
+				return 1, nil
+			})
+		}, g2cache.OpGet, g2cache.TierSource, g2cache.DataSourceLoadTimeout, true},
+		{"out storage down", func() error {
+			atomic.StoreInt32(&out.down, 1)
+			defer atomic.StoreInt32(&out.down, 0)
+			return g.Set("down", 1, time.Minute, true)
+		}, g2cache.OpSet, g2cache.TierOut, errOutDown, true},
+		{"inspect", func() error {
+			atomic.StoreInt32(&out.down, 1)
+			defer atomic.StoreInt32(&out.down, 0)
+			_, err := g.Inspect("down")
+			return err
+		}, g2cache.OpInspect, g2cache.TierOut, errOutDown, true},
+		{"refresh local", func() error {
+			atomic.StoreInt32(&out.down, 1)
+			defer atomic.StoreInt32(&out.down, 0)
+			return g.RefreshLocal("down")
+		}, g2cache.OpRefresh, g2cache.TierOut, errOutDown, true},
+		{"flush", func() error {
+			if err := g.Set("flush:a", 1, time.Minute, true); err != nil {
+				return err
+			}
+			atomic.StoreInt32(&out.down, 1)
+			defer atomic.StoreInt32(&out.down, 0)
+			_, err := g.Flush("flush:")
+			return err
+		}, g2cache.OpFlush, g2cache.TierOut, errOutDown, true},
+		{"update func", func() error {
+			return g.Update("update", time.Minute, &v, func(old interface{}) (interface{}, error) {
+				return nil, errors.New("rejected")
+			})
+		}, g2cache.OpUpdate, "", nil, false},
+	} {
+		err := tt.call()
+		var ce *g2cache.CacheError
+		if !errors.As(err, &ce) || ce.Op != tt.op || ce.Tier != tt.tier || ce.Key == "" {
+			t.Fatalf("%s returned %#v, want a CacheError of op %q tier %q", tt.name, err, tt.op, tt.tier)
+		}
+		if tt.target != nil && !errors.Is(err, tt.target) {
+			t.Fatalf("%s returned %v, want it to wrap %v", tt.name, err, tt.target)
+		}
+		if g2cache.IsTransient(err) != tt.transient {
+			t.Fatalf("%s returned %v, transient %v, want %v", tt.name, err, !tt.transient, tt.transient)
+		}
+	}
+
+	// argument and state errors are returned as is
+	if err := g.Get("", time.Minute, &v, nil); err != g2cache.CacheKeyEmpty {
+		t.Fatalf("empty key returned %#v", err)
+	}
+
+	// errors of background work have no operation
+	for _, tt := range []struct {
+		err  *g2cache.CacheError
+		want string
+	}{
+		{&g2cache.CacheError{Op: g2cache.OpSet, Key: "a", Tier: g2cache.TierOut, Err: errOutDown}, "g2cache set key a out storage: " + errOutDown.Error()},
+		{&g2cache.CacheError{Key: "a", Tier: g2cache.TierOut, Err: errOutDown}, "g2cache key a out storage: " + errOutDown.Error()},
+		{&g2cache.CacheError{Key: "a", Err: errOutDown}, "g2cache key a: " + errOutDown.Error()},
+	} {
+		if got := tt.err.Error(); got != tt.want {
+			t.Fatalf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+// sameShardKeys return n keys of the lock shard of key
+func sameShardKeys(key string, n int) []string {
+	shard := func(key string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		return h.Sum64() & 255
+	}
+	var keys []string
+	for i := 0; len(keys) < n; i++ {
+		if k := fmt.Sprint("shard:", i); shard(k) == shard(key) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func TestLoaderRetryDoesNotBlockOtherKeys(t *testing.T) {
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache(),
+		g2cache.WithDefaultLoaderTimeout(100*time.Millisecond), g2cache.WithDefaultLoaderRetry(2, 100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	// the hung key spends about 500ms in timeouts and backoffs
+	release := make(chan struct{})
+	defer close(release)
+	done := make(chan error, 1)
+	go func() {
+		var v int
+		done <- g.Get("hung", time.Minute, &v, func() (interface{}, error) {
+			<-release
+			return 1, nil
+		})
+	}()
+
+	// keys of the same shard load meanwhile without waiting for it
+	var slowest time.Duration
+	for _, key := range sameShardKeys("hung", 100) {
+		start := time.Now()
+		var v int
+		if err := g.Get(key, time.Minute, &v, func() (interface{}, error) {
+			return 1, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d > slowest {
+			slowest = d
+		}
+		select {
+		case err := <-done:
+			if !errors.Is(err, g2cache.DataSourceLoadTimeout) {
+				t.Fatalf("hung loader returned %v", err)
+			}
+			if slowest > 50*time.Millisecond {
+				t.Fatalf("a key of the same shard waited %v", slowest)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("hung loader did not give up")
+}
+
+func TestLoadLimitFailFast(t *testing.T) {
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache(), g2cache.WithLoadLimits(
+		g2cache.LoadLimit{Prefix: "user:", MaxInFlight: 1, Policy: g2cache.LoadLimitFailFast},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		var v int
+		done <- g.Get("user:1", time.Minute, &v, func() (interface{}, error) {
+			close(started)
+			<-release
+			return 1, nil
+		})
+	}()
+	<-started
+
+	var v int
+	load := func() (interface{}, error) {
+		return 2, nil
+	}
+	if err := g.Get("user:2", time.Minute, &v, load); !errors.Is(err, g2cache.DataSourceLoadLimited) {
+		t.Fatalf("load over the limit returned %v, want %v", err, g2cache.DataSourceLoadLimited)
+	}
+	if err := g.Get("order:2", time.Minute, &v, load); err != nil {
+		t.Fatalf("load without limit returned %v", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Get("user:2", time.Minute, &v, load); err != nil || v != 2 {
+		t.Fatalf("got %d, %v after the limit was released, want 2", v, err)
+	}
+}
+
+func TestLoadLimitWaitOutsideKeyLock(t *testing.T) {
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache(), g2cache.WithClock(clock), g2cache.WithLoadLimits(
+		g2cache.LoadLimit{Prefix: "limited:", MaxInFlight: 1, Policy: g2cache.LoadLimitWait},
+		g2cache.LoadLimit{Prefix: "rate:", Rate: 1, Burst: 1, Policy: g2cache.LoadLimitWait, MaxWait: 10 * time.Second},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	// limited:a holds the only slot, limited:b waits for it
+	started, gate := make(chan struct{}), make(chan struct{})
+	done := make(chan error, 2)
+	go func() {
+		var v int
+		done <- g.Get("limited:a", time.Minute, &v, func() (interface{}, error) {
+			close(started)
+			<-gate
+			return 1, nil
+		})
+	}()
+	<-started
+	go func() {
+		var v int
+		done <- g.Get("limited:b", time.Minute, &v, func() (interface{}, error) {
+			return 2, nil
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// the waiting load does not hold the lock of its shard
+	for _, key := range sameShardKeys("limited:b", 3) {
+		start := time.Now()
+		var v int
+		if err := g.Get(key, time.Minute, &v, func() (interface{}, error) {
+			return 3, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d > 50*time.Millisecond {
+			t.Fatalf("%s waited %v for a throttled load of its shard", key, d)
+		}
+	}
+	close(gate)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the rate limit waits by the clock of the cache
+	var v int
+	load := func() (interface{}, error) {
+		return 4, nil
+	}
+	if err := g.Get("rate:a", time.Minute, &v, load); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var v int
+		done <- g.Get("rate:b", time.Minute, &v, load)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("rate limited load returned %v without waiting", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	waitFor(t, "rate limited load", func() bool {
+		clock.Advance(100 * time.Millisecond)
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return true
+		default:
+			return false
+		}
+	})
+}
+
+func TestAdminHandler(t *testing.T) {
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	for i := 0; i < 3; i++ {
+		if err := g.Set(fmt.Sprint("user:", i), i, time.Minute, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Set("order:1", 1, time.Minute, true); err != nil {
+		t.Fatal(err)
+	}
+
+	token := "secret"
+	h := g2cache.NewAdminHandler(g, func(r *http.Request) error {
+		if r.Method != http.MethodGet && r.Header.Get("X-Token") != token {
+			return errors.New("bad token")
+		}
+		return nil
+	})
+	do := func(method, target string, header string, v interface{}) int {
+		t.Helper()
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("X-Token", header)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if v != nil {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+
+	var info g2cache.KeyInfo
+	if code := do(http.MethodGet, "/key?key=user:1", "", &info); code != http.StatusOK || !info.Local.Found || !info.Out.Found || info.Out.Size != 1 {
+		t.Fatalf("inspect returned %d %+v", code, info)
+	}
+	if code := do(http.MethodPost, "/flush?prefix=user:", "", nil); code != http.StatusForbidden {
+		t.Fatalf("flush without token returned %d", code)
+	}
+	var flushed map[string]int
+	if code := do(http.MethodPost, "/flush?prefix=user:", token, &flushed); code != http.StatusOK || flushed["deleted"] != 3 {
+		t.Fatalf("flush returned %d %v", code, flushed)
+	}
+	if local, out, err := g.Exists("user:1"); err != nil || local || out {
+		t.Fatalf("user:1 exists after flush, local %v, out %v, %v", local, out, err)
+	}
+	if local, out, err := g.Exists("order:1"); err != nil || !local || !out {
+		t.Fatalf("order:1 flushed, local %v, out %v, %v", local, out, err)
+	}
+}
+
+func TestFlushBatches(t *testing.T) {
+	defer func(n int) {
+		g2cache.FlushBatchSize = n
+	}(g2cache.FlushBatchSize)
+	g2cache.FlushBatchSize = 2
+	out := &batchOut{MemOutCache: g2cachetest.NewMemOutCache()}
+	g, err := g2cache.New(out, g2cache.NewFreeCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := g.Set(fmt.Sprint("flush:", i), i, time.Minute, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Set("flush:local", 5, time.Minute, true, g2cache.WithLocalOnly()); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Set("kept", 6, time.Minute, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// out storage keys are deleted in batches while scanned, then the keys only in local storage
+	n, err := g.Flush("flush:")
+	if err != nil || n != 6 {
+		t.Fatalf("flush return %d, %v, want 6", n, err)
+	}
+	if got := fmt.Sprint(out.Batches()); got != "[2 2 1 1]" {
+		t.Fatalf("got batches %s, want [2 2 1 1]", got)
+	}
+	for _, key := range []string{"flush:0", "flush:4", "flush:local"} {
+		if local, out, err := g.Exists(key); local || out || err != nil {
+			t.Fatalf("%s exists after flush, local %v, out %v, %v", key, local, out, err)
+		}
+	}
+	if local, out, err := g.Exists("kept"); !local || !out || err != nil {
+		t.Fatalf("kept flushed, local %v, out %v, %v", local, out, err)
+	}
+
+	// admin methods stop with the cache
+	g.Close()
+	if _, err := g.Inspect("kept"); err != g2cache.CacheClose {
+		t.Fatalf("inspect after close return %v", err)
+	}
+	if err := g.RefreshLocal("kept"); err != g2cache.CacheClose {
+		t.Fatalf("refresh after close return %v", err)
+	}
+	if _, err := g.Flush("kept"); err != g2cache.CacheClose {
+		t.Fatalf("flush after close return %v", err)
+	}
+}
+
+func TestSnapshotWarmStart(t *testing.T) {
+	clock := g2cachetest.NewFakeClock(time.Unix(1600000000, 0))
+	file := filepath.Join(t.TempDir(), "local.snapshot")
+	g, err := g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache(),
+		g2cache.WithClock(clock), g2cache.WithSnapshotFile(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Set("short", "gone", time.Second, true, g2cache.WithLocalOnly(), g2cache.WithHardTTL(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Set("long", "kept", time.Minute, true, g2cache.WithLocalOnly()); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if n, err := g.Snapshot(&buf); err != nil || n != 2 {
+		t.Fatalf("snapshot wrote %d entries, %v, want 2", n, err)
+	}
+	g.Close()
+	if fi, err := os.Stat(file); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("snapshot file %v, %v, want mode 0600", fi, err)
+	}
+
+	// a fresh cache restores the file on New, skipping the expired entry
+	clock.Advance(10 * time.Second)
+	g, err = g2cache.New(g2cachetest.NewMemOutCache(), g2cache.NewFreeCache(),
+		g2cache.WithClock(clock), g2cache.WithSnapshotFile(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	var v string
+	if ok, err := g.Peek("long", &v, g2cache.WithLocalOnly()); err != nil || !ok || v != "kept" {
+		t.Fatalf("peek restored key got %q, %v, %v", v, ok, err)
+	}
+	if ok, err := g.Peek("short", &v, g2cache.WithLocalOnly()); err != nil || ok {
+		t.Fatalf("expired key restored: %v, %v", ok, err)
+	}
+
+	// an explicit Restore of the earlier snapshot skips the expired entry as well
+	if n, err := g.Restore(&buf); err != nil || n != 1 {
+		t.Fatalf("restored %d entries, %v, want 1", n, err)
+	}
+}
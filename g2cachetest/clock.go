@@ -0,0 +1,99 @@
+// Package g2cachetest provides helpers for testing code built on g2cache without sleeping or a Redis server
+package g2cachetest
+
+import (
+	"gitee.com/kelvins-io/g2cache"
+	"sync"
+	"time"
+)
+
+// FakeClock only moves when Advance or Set is called, pass it to g2cache.WithClock
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d and fires the tickers that became due
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.fire()
+	c.mu.Unlock()
+}
+
+// Set moves the clock to now, tickers only fire when it moves forward
+func (c *FakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	c.now = now
+	c.fire()
+	c.mu.Unlock()
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) g2cache.Ticker {
+	if d <= 0 {
+		panic("g2cachetest: non-positive interval for NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{
+		clock:  c,
+		period: d,
+		next:   c.now.Add(d),
+		c:      make(chan time.Time, 1),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// fire like time.Ticker, a tick is dropped if the previous one was not received yet
+func (c *FakeClock) fire() {
+	for _, t := range c.tickers {
+		if t.next.After(c.now) {
+			continue
+		}
+		for !t.next.After(c.now) {
+			t.next = t.next.Add(t.period)
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+	}
+}
+
+func (c *FakeClock) stop(t *fakeTicker) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, ft := range c.tickers {
+		if ft == t {
+			c.tickers = append(c.tickers[:i], c.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock  *FakeClock
+	period time.Duration
+	next   time.Time
+	c      chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.stop(t)
+}
@@ -0,0 +1,164 @@
+package g2cachetest
+
+import (
+	"encoding/json"
+	"gitee.com/kelvins-io/g2cache"
+	"github.com/mohae/deepcopy"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemOutCache is an in-process g2cache.OutCache, like RedisCache values are kept until Entry.Expiration plus g2cache.StaleIfErrorSecond,
+// by the clock given with SetClock
+type MemOutCache struct {
+	// BeforeCommit, if set before the cache is used, runs in CompareAndSwap between reading the old value and writing the new one,
+	// a write to the key from there makes the swap conflict and retry
+	BeforeCommit func(key string)
+	mu           sync.Mutex
+	values       map[string][]byte
+	versions     map[string]uint64 // bumped by every write of a key
+	counters     map[string]int64
+	clock        g2cache.Clock
+}
+
+func NewMemOutCache() *MemOutCache {
+	return &MemOutCache{
+		values:   make(map[string][]byte),
+		versions: make(map[string]uint64),
+		counters: make(map[string]int64),
+		clock:    g2cache.SystemClock,
+	}
+}
+
+func (m *MemOutCache) SetClock(c g2cache.Clock) {
+	m.mu.Lock()
+	m.clock = c
+	m.mu.Unlock()
+}
+
+func (m *MemOutCache) Get(key string, obj interface{}) (*g2cache.Entry, bool, error) {
+	m.mu.Lock()
+	b, ok := m.values[key]
+	m.mu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+	e := new(g2cache.Entry)
+	e.Value = obj // Save the reflection structure of obj
+	if err := json.Unmarshal(b, e); err != nil {
+		return nil, false, err
+	}
+	m.mu.Lock()
+	now := m.clock.Now()
+	m.mu.Unlock()
+	if e.ExpiredAt(now) && !e.StaleUsableAt(time.Duration(g2cache.StaleIfErrorSecond)*time.Second, now) {
+		m.Del(key)
+		return nil, false, nil
+	}
+	return e, true, nil
+}
+
+func (m *MemOutCache) Set(key string, e *g2cache.Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.values[key] = b
+	m.versions[key]++
+	m.mu.Unlock()
+	return nil
+}
+
+// CompareAndSwap implements g2cache.CasOutCache optimistically like RedisCache, fn runs without the lock
+// and the swap is retried g2cache.UpdateMaxRetry times if the key was written meanwhile
+func (m *MemOutCache) CompareAndSwap(key string, obj interface{}, fn func(old *g2cache.Entry) (*g2cache.Entry, error)) (*g2cache.Entry, error) {
+	for i := 0; i < g2cache.UpdateMaxRetry; i++ {
+		m.mu.Lock()
+		b, ok := m.values[key]
+		version := m.versions[key]
+		m.mu.Unlock()
+		var old *g2cache.Entry
+		if ok {
+			old = new(g2cache.Entry)
+			old.Value = deepcopy.Copy(obj) // Save the reflection structure of obj
+			if err := json.Unmarshal(b, old); err != nil {
+				return nil, err
+			}
+		}
+		e, err := fn(old)
+		if err != nil {
+			return nil, err
+		}
+		b, err = json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		if m.BeforeCommit != nil {
+			m.BeforeCommit(key)
+		}
+		m.mu.Lock()
+		if m.versions[key] == version {
+			m.values[key] = b
+			m.versions[key]++
+			m.mu.Unlock()
+			return e, nil
+		}
+		m.mu.Unlock()
+	}
+	return nil, g2cache.UpdateConflict
+}
+
+// IncrBy implements g2cache.CounterOutCache
+func (m *MemOutCache) IncrBy(key string, delta int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[key] += delta
+	return m.counters[key], nil
+}
+
+// GetCounter implements g2cache.CounterOutCache
+func (m *MemOutCache) GetCounter(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[key], nil
+}
+
+func (m *MemOutCache) Del(key string) error {
+	m.mu.Lock()
+	delete(m.values, key)
+	m.versions[key]++
+	delete(m.counters, key)
+	m.mu.Unlock()
+	return nil
+}
+
+// Scan implements g2cache.ScanOutCache
+func (m *MemOutCache) Scan(prefix string, fn func(key string) bool) error {
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	m.mu.Unlock()
+	for _, key := range keys {
+		if !fn(key) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Len return the number of stored keys, expired ones included until they are read
+func (m *MemOutCache) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.values)
+}
+
+func (m *MemOutCache) ThreadSafe() {}
+
+func (m *MemOutCache) Close() {}
@@ -2,8 +2,10 @@ package g2cache
 
 // thank https://github.com/ivpusic/grpool
 import (
+	"context"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,31 +18,60 @@ type worker struct {
 func (w *worker) start() {
 	go func() {
 		if CacheDebug {
-			LogDebugF("Pool [%d] worker start\n", w.id)
+			LogDebugW("pool worker start", Field("worker", w.id))
 		}
 		defer func() {
-			w.pool.wg.Done()
+			w.pool.workerWg.Done()
 		}()
+		idle := time.NewTimer(w.pool.idleTimeout())
+		defer idle.Stop()
 		for {
+			// stop first, queued jobs are discarded by Pool.release
 			select {
-			case <-w.pool.stopped:
+			case <-w.pool.workerStop:
 				if CacheDebug {
-					LogDebugF("Pool [%d] worker <-stop\n", w.id)
-				}
-				if len(w.pool.jobQueue) != 0 {
-					for job := range w.pool.jobQueue {
-						runJob(w.id, job)
-					}
+					LogDebugW("pool worker exit", Field("worker", w.id))
 				}
+				return
+			default:
+			}
+			// high priority jobs first
+			select {
+			case job := <-w.pool.highQueue:
+				runJob(w.id, job)
+				continue
+			default:
+			}
+			atomic.AddInt64(&w.pool.idle, 1)
+			select {
+			case <-w.pool.workerStop:
+				atomic.AddInt64(&w.pool.idle, -1)
 				if CacheDebug {
-					LogDebugF("Pool [%d] worker exit\n", w.id)
+					LogDebugW("pool worker exit", Field("worker", w.id))
 				}
 				return
-			case job, ok := <-w.pool.jobQueue:
-				if ok {
-					runJob(w.id, job)
+			case job := <-w.pool.highQueue:
+				atomic.AddInt64(&w.pool.idle, -1)
+				runJob(w.id, job)
+			case job := <-w.pool.jobQueue:
+				atomic.AddInt64(&w.pool.idle, -1)
+				runJob(w.id, job)
+			case <-idle.C:
+				atomic.AddInt64(&w.pool.idle, -1)
+				if w.pool.retire() {
+					if CacheDebug {
+						LogDebugW("pool worker idle exit", Field("worker", w.id))
+					}
+					return
 				}
 			}
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(w.pool.idleTimeout())
 		}
 	}()
 }
@@ -49,22 +80,21 @@ func runJob(id int64, f func()) {
 	defer func() {
 		if err := recover(); err != nil {
 			if CacheDebug {
-				LogErrF("Pool [%d] Job panic err: %v, stack: %v\n", id, err,string(outputStackErr()))
+				LogErrW("pool job panic", Field("worker", id), Field("panic", err), Field("stack", string(outputStackErr())))
 			}
 		}
 	}()
 	f()
 }
 
-func outputStackErr() []byte  {
+func outputStackErr() []byte {
 	var (
-		buf    [4096]byte
+		buf [4096]byte
 	)
 	n := runtime.Stack(buf[:], false)
 	return buf[:n]
 }
 
-
 func newWorker(id int64, pool *Pool) *worker {
 	w := &worker{
 		id:   id,
@@ -77,12 +107,58 @@ func newWorker(id int64, pool *Pool) *worker {
 // Represents user request, function which should be executed in some worker.
 type Job func()
 
+const (
+	PriorityLow  = iota // e.g. refreshing obsolete entries, subject to the overflow policy
+	PriorityHigh        // for other users of Pool, runs before any queued low priority job. G2Cache orders its writes with key jobs instead
+)
+
+// What SendJob does when the job queue is full
+const (
+	PoolOverflowBlock      = iota // wait for room in the queue
+	PoolOverflowDropNewest        // discard the job being sent
+	PoolOverflowDropOldest        // discard the oldest queued job to make room
+	PoolOverflowRunInline         // run the job in the sending goroutine
+)
+
+type PoolConf struct {
+	MinWorkers       int // workers kept alive when idle
+	MaxWorkers       int // workers are added while jobs are queued and no worker is idle, up to this number
+	QueueLen         int
+	WorkerIdleSecond int // a worker above MinWorkers exits after being idle this long
+	Overflow         int // PoolOverflowBlock, PoolOverflowDropNewest, PoolOverflowDropOldest or PoolOverflowRunInline
+}
+
+type PoolStatistics struct {
+	Workers       int64 `json:"workers"`
+	IdleWorkers   int64 `json:"idle_workers"`
+	QueueLen      int   `json:"queue_len"`
+	HighQueueLen  int   `json:"high_queue_len"`
+	LongRunning   int64 `json:"long_running"`
+	Submitted     int64 `json:"submitted"`
+	Blocked       int64 `json:"blocked"`
+	DroppedNewest int64 `json:"dropped_newest"`
+	DroppedOldest int64 `json:"dropped_oldest"`
+	RanInline     int64 `json:"ran_inline"`
+}
+
 type Pool struct {
-	jobQueue chan Job
-	workers  []*worker
-	stopOne  sync.Once
-	stopped  chan struct{}
-	wg       sync.WaitGroup
+	conf      PoolConf
+	jobQueue  chan Job // low priority jobs
+	highQueue chan Job
+	long      int64 // goroutines started by Go
+	workerNum int64 // live workers
+	idle      int64 // workers waiting for a job
+	workerID  int64
+	lanes     []chan Job // jobs of the same key run in one lane, in submission order
+	keyJobs   int64      // key jobs queued or running
+	stat      PoolStatistics
+	stopOne   sync.Once
+	stopped   chan struct{}
+	wg        sync.WaitGroup // lanes, the monitor and functions started by Go
+	// workers stop before the rest of the pool, see StopWorkers
+	workerStopOne sync.Once
+	workerStop    chan struct{}
+	workerWg      sync.WaitGroup
 }
 
 // Will make pool of gorouting workers.
@@ -91,16 +167,49 @@ type Pool struct {
 //
 // Returned object contains JobQueue reference, which you can use to send job to pool.
 func NewPool(numWorkers int, jobQueueLen int) *Pool {
+	return NewPoolWithConf(PoolConf{
+		MinWorkers: numWorkers,
+		MaxWorkers: numWorkers,
+		QueueLen:   jobQueueLen,
+		Overflow:   PoolOverflowBlock,
+	})
+}
 
+// NewPoolWithConf make a pool that scales its workers between conf.MinWorkers and conf.MaxWorkers
+func NewPoolWithConf(conf PoolConf) *Pool {
+	if conf.MinWorkers < 0 {
+		conf.MinWorkers = 0
+	}
+	if conf.MaxWorkers <= 0 {
+		conf.MaxWorkers = 1
+	}
+	if conf.MaxWorkers < conf.MinWorkers {
+		conf.MaxWorkers = conf.MinWorkers
+	}
+	if conf.WorkerIdleSecond <= 0 {
+		conf.WorkerIdleSecond = 60
+	}
+	laneNum := DefaultGPoolKeyLaneNum
+	if laneNum <= 0 {
+		laneNum = 1
+	}
 	pool := &Pool{
-		jobQueue: make(chan Job, jobQueueLen),
-		workers:  make([]*worker, numWorkers),
-		stopped:  make(chan struct{}),
+		conf:       conf,
+		jobQueue:   make(chan Job, conf.QueueLen),
+		highQueue:  make(chan Job, conf.QueueLen),
+		lanes:      make([]chan Job, laneNum),
+		stopped:    make(chan struct{}),
+		workerStop: make(chan struct{}),
 	}
 
-	for i := 0; i < numWorkers; i++ {
+	for i := 0; i < conf.MinWorkers; i++ {
+		pool.addWorker()
+	}
+
+	for i := 0; i < laneNum; i++ {
+		pool.lanes[i] = make(chan Job, conf.QueueLen)
 		pool.wg.Add(1)
-		pool.workers[i] = newWorker(int64(i), pool)
+		go pool.runLane(int64(-1-i), pool.lanes[i])
 	}
 
 	if CacheMonitor {
@@ -115,13 +224,67 @@ func (p *Pool) wrapJob(job func()) func() {
 	return job
 }
 
+func (p *Pool) addWorker() {
+	atomic.AddInt64(&p.workerNum, 1)
+	p.workerWg.Add(1)
+	newWorker(atomic.AddInt64(&p.workerID, 1), p)
+}
+
+// scale adds a worker while queued jobs outnumber idle workers
+func (p *Pool) scale() {
+	for int64(len(p.jobQueue)+len(p.highQueue)) > atomic.LoadInt64(&p.idle) {
+		n := atomic.LoadInt64(&p.workerNum)
+		if n >= int64(p.conf.MaxWorkers) {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&p.workerNum, n, n+1) {
+			p.workerWg.Add(1)
+			newWorker(atomic.AddInt64(&p.workerID, 1), p)
+			return
+		}
+	}
+}
+
+// retire lets an idle worker exit if there are more than MinWorkers
+func (p *Pool) retire() bool {
+	for {
+		n := atomic.LoadInt64(&p.workerNum)
+		if n <= int64(p.conf.MinWorkers) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&p.workerNum, n, n-1) {
+			return true
+		}
+	}
+}
+
+func (p *Pool) idleTimeout() time.Duration {
+	return time.Duration(p.conf.WorkerIdleSecond) * time.Second
+}
+
+func (p *Pool) Statistics() PoolStatistics {
+	return PoolStatistics{
+		Workers:       atomic.LoadInt64(&p.workerNum),
+		IdleWorkers:   atomic.LoadInt64(&p.idle),
+		QueueLen:      len(p.jobQueue),
+		HighQueueLen:  len(p.highQueue),
+		LongRunning:   atomic.LoadInt64(&p.long),
+		Submitted:     atomic.LoadInt64(&p.stat.Submitted),
+		Blocked:       atomic.LoadInt64(&p.stat.Blocked),
+		DroppedNewest: atomic.LoadInt64(&p.stat.DroppedNewest),
+		DroppedOldest: atomic.LoadInt64(&p.stat.DroppedOldest),
+		RanInline:     atomic.LoadInt64(&p.stat.RanInline),
+	}
+}
+
 func (p *Pool) SendJobWithTimeout(job func(), t time.Duration) bool {
 	select {
-	case <-p.stopped:
+	case <-p.workerStop:
 		return false
 	case <-time.After(t):
 		return false
 	case p.jobQueue <- p.wrapJob(job):
+		p.scale()
 		return true
 	}
 }
@@ -132,65 +295,238 @@ func (p *Pool) SendJobWithDeadline(job func(), t time.Time) bool {
 		s = time.Second // timeout
 	}
 	select {
-	case <-p.stopped:
+	case <-p.workerStop:
 		return false
 	case <-time.After(s):
 		return false
 	case p.jobQueue <- p.wrapJob(job):
+		p.scale()
 		return true
 	}
 }
 
+// SendJobWithPriority a PriorityHigh job is never dropped, it waits for room in the high priority queue
+func (p *Pool) SendJobWithPriority(job func(), priority int) {
+	if priority != PriorityHigh {
+		p.SendJob(job)
+		return
+	}
+	select {
+	case p.highQueue <- p.wrapJob(job):
+		p.scale()
+	case <-p.workerStop:
+		return
+	}
+}
+
+// Go runs a long-lived function such as a subscribe loop outside the worker budget, Release waits for it to return
+func (p *Pool) Go(f func()) {
+	select {
+	case <-p.stopped:
+		return
+	default:
+	}
+	p.wg.Add(1)
+	atomic.AddInt64(&p.long, 1)
+	go func() {
+		defer func() {
+			atomic.AddInt64(&p.long, -1)
+			p.wg.Done()
+		}()
+		runJob(0, f)
+	}()
+}
+
+// SendJob applies the overflow policy of the pool when the job queue is full
 func (p *Pool) SendJob(job func()) {
+	select {
+	case <-p.workerStop:
+		return
+	default:
+	}
+	atomic.AddInt64(&p.stat.Submitted, 1)
+	defer p.scale()
 	select {
 	case p.jobQueue <- p.wrapJob(job):
-	case <-p.stopped:
+		return
+	default:
+	}
+	switch p.conf.Overflow {
+	case PoolOverflowDropNewest:
+		atomic.AddInt64(&p.stat.DroppedNewest, 1)
+		return
+	case PoolOverflowDropOldest:
+		for {
+			select {
+			case p.jobQueue <- p.wrapJob(job):
+				return
+			case <-p.workerStop:
+				return
+			default:
+			}
+			select {
+			case <-p.jobQueue:
+				atomic.AddInt64(&p.stat.DroppedOldest, 1)
+			default:
+			}
+		}
+	case PoolOverflowRunInline:
+		atomic.AddInt64(&p.stat.RanInline, 1)
+		runJob(0, job)
+		return
+	}
+	atomic.AddInt64(&p.stat.Blocked, 1)
+	p.scale()
+	select {
+	case p.jobQueue <- p.wrapJob(job):
+	case <-p.workerStop:
 		return
 	}
 }
 
-func (p *Pool) monitor() {
-	t := time.NewTicker(time.Duration(CacheMonitorSecond) * time.Second)
+// Each lane is served by a single goroutine, so jobs sent to it never run concurrently or out of order
+func (p *Pool) runLane(id int64, lane chan Job) {
+	defer p.wg.Done()
 	for {
 		select {
 		case <-p.stopped:
-			t.Stop()
 			return
+		default:
+		}
+		select {
+		case <-p.stopped:
+			return
+		case job := <-lane:
+			runJob(id, job)
+			atomic.AddInt64(&p.keyJobs, -1)
+		}
+	}
+}
+
+// SendKeyJob jobs with the same key are executed in submission order, jobs with different keys still run in parallel
+func (p *Pool) SendKeyJob(key string, job func()) {
+	p.sendKeyJob(key, job)
+}
+
+// sendKeyJob return false if the pool is released and the job will never run
+func (p *Pool) sendKeyJob(key string, job func()) bool {
+	lane := p.lanes[fnv64a{}.Sum64(key)%uint64(len(p.lanes))]
+	atomic.AddInt64(&p.keyJobs, 1)
+	select {
+	case lane <- p.wrapJob(job):
+		return true
+	case <-p.stopped:
+		atomic.AddInt64(&p.keyJobs, -1)
+		return false
+	}
+}
+
+// DrainKeyJobs waits until all key jobs have run, it return how many queued key jobs were discarded because ctx was done first
+func (p *Pool) DrainKeyJobs(ctx context.Context) int {
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for atomic.LoadInt64(&p.keyJobs) > 0 {
+		select {
+		case <-ctx.Done():
+			return p.discardKeyJobs()
 		case <-t.C:
-			LogDebug("Pool jobQueue current len ", len(p.jobQueue))
 		}
 	}
+	return 0
 }
 
-func (p *Pool) release() {
-	close(p.stopped)
-	force := make(chan struct{})
-	forceOne := sync.Once{}
-	go func() {
+func (p *Pool) discardKeyJobs() (n int) {
+	for _, lane := range p.lanes {
+	DISCARD:
 		for {
 			select {
-			case <-force:
-				return
+			case <-lane:
+				atomic.AddInt64(&p.keyJobs, -1)
+				n++
 			default:
-				p.wg.Wait() // why always some goroutine not exit,who found bug
-				forceOne.Do(func() {
-					close(force)
-				})
-				return
+				break DISCARD
 			}
 		}
-	}()
-	// forceExit
-	time.AfterFunc(5*time.Second, func() {
-		forceOne.Do(func() {
-			close(force)
-		})
+	}
+	return n
+}
+
+func (p *Pool) monitor() {
+	t := time.NewTicker(time.Duration(CacheMonitorSecond) * time.Second)
+	for {
+		select {
+		case <-p.stopped:
+			t.Stop()
+			return
+		case <-t.C:
+			LogDebugW("pool statistics", Field("queue_len", len(p.jobQueue)), Field("high_queue_len", len(p.highQueue)), Field("workers", atomic.LoadInt64(&p.workerNum)))
+		}
+	}
+}
+
+// StopWorkers stops the workers after the job in hand and discards the queued jobs, it return how many were discarded.
+// Key jobs and functions started by Go keep running until Release, so running jobs can still send key jobs.
+// It gives up waiting for the running jobs once ctx is done
+func (p *Pool) StopWorkers(ctx context.Context) (discarded int, err error) {
+	p.workerStopOne.Do(func() {
+		close(p.workerStop)
 	})
-	<-force
-	close(p.jobQueue)
+	err = waitGroupContext(ctx, &p.workerWg)
+	discarded = discardJobs(p.highQueue) + discardJobs(p.jobQueue)
+	return discarded, err
 }
 
-// Will release resources used by pool
-func (p *Pool) Release() {
-	p.stopOne.Do(p.release)
+func waitGroupContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release stops workers, lanes and the monitor, they exit after the job in hand without taking queued ones.
+// The job channels are never closed, so a concurrent send can not panic, it is discarded instead
+func (p *Pool) release(ctx context.Context) (discarded int, err error) {
+	discarded, err = p.StopWorkers(ctx)
+	close(p.stopped)
+	if werr := waitGroupContext(ctx, &p.wg); werr != nil {
+		// only a function started by Go that ignores its stop signal can get here
+		err = werr
+	}
+	discarded += p.discardKeyJobs()
+	if discarded > 0 && CacheDebug {
+		LogDebugW("pool release discarded jobs", Field("discarded", discarded))
+	}
+	return discarded, err
+}
+
+func discardJobs(queue chan Job) (n int) {
+	for {
+		select {
+		case <-queue:
+			n++
+		default:
+			return n
+		}
+	}
+}
+
+// Will release resources used by pool, it waits for running jobs and return how many queued jobs were discarded
+func (p *Pool) Release() int {
+	n, _ := p.ReleaseContext(context.Background())
+	return n
+}
+
+// ReleaseContext is Release which gives up waiting once ctx is done
+func (p *Pool) ReleaseContext(ctx context.Context) (discarded int, err error) {
+	p.stopOne.Do(func() {
+		discarded, err = p.release(ctx)
+	})
+	return discarded, err
 }
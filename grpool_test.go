@@ -0,0 +1,267 @@
+package g2cache
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolReleaseNoLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	pool := NewPoolWithConf(PoolConf{MinWorkers: 1, MaxWorkers: 1, QueueLen: 16})
+	started, gate := make(chan struct{}), make(chan struct{})
+	var ran int64
+	pool.SendJob(func() {
+		close(started)
+		<-gate
+		atomic.AddInt64(&ran, 1)
+	})
+	for i := 0; i < 10; i++ {
+		pool.SendJob(func() {
+			atomic.AddInt64(&ran, 1)
+		})
+	}
+	keyDone := make(chan struct{})
+	pool.SendKeyJob("g2cache", func() {
+		close(keyDone)
+	})
+	pool.Go(func() {})
+	<-started
+	<-keyDone
+
+	released := make(chan int)
+	go func() {
+		released <- pool.Release()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(gate)
+
+	discarded := <-released
+	if n := atomic.LoadInt64(&ran); n != 1 {
+		t.Fatalf("ran %d jobs after release, want 1", n)
+	}
+	if discarded != 10 {
+		t.Fatalf("discarded %d jobs, want 10", discarded)
+	}
+	// send after release must neither block nor panic
+	pool.SendJob(func() {})
+	pool.SendJobWithPriority(func() {}, PriorityHigh)
+	pool.SendKeyJob("g2cache", func() {})
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		buf := make([]byte, 1<<16)
+		t.Fatalf("goroutine leak: before %d, after %d\n%s", before, after, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestPoolKeyJobOrder(t *testing.T) {
+	pool := NewPoolWithConf(PoolConf{MinWorkers: 1, MaxWorkers: 1, QueueLen: 128})
+	defer pool.Release()
+
+	// jobs of one key run in submission order
+	var got []int
+	done := make(chan struct{})
+	for i := 0; i < 100; i++ {
+		i := i
+		pool.SendKeyJob("order", func() {
+			got = append(got, i)
+		})
+	}
+	pool.SendKeyJob("order", func() {
+		close(done)
+	})
+	<-done
+	for i, v := range got {
+		if v != i {
+			t.Fatalf("job %d ran at position %d", v, i)
+		}
+	}
+
+	// a blocked key does not hold up a key of another lane
+	lane := func(key string) uint64 {
+		return fnv64a{}.Sum64(key) % uint64(len(pool.lanes))
+	}
+	blocked, other := "blocked", ""
+	for i := 0; other == ""; i++ {
+		if key := fmt.Sprint("other:", i); lane(key) != lane(blocked) {
+			other = key
+		}
+	}
+	gate, otherDone := make(chan struct{}), make(chan struct{})
+	defer close(gate)
+	pool.SendKeyJob(blocked, func() {
+		<-gate
+	})
+	pool.SendKeyJob(other, func() {
+		close(otherDone)
+	})
+	select {
+	case <-otherDone:
+	case <-time.After(time.Second):
+		t.Fatal("key job of another lane waited for a blocked lane")
+	}
+}
+
+func TestPoolScale(t *testing.T) {
+	pool := NewPoolWithConf(PoolConf{MinWorkers: 1, MaxWorkers: 4, QueueLen: 16, WorkerIdleSecond: 1})
+	defer pool.Release()
+
+	// a worker is added while jobs are queued and no worker is idle, up to MaxWorkers
+	var running int64
+	gate := make(chan struct{})
+	for i := 0; i < 6; i++ {
+		pool.SendJob(func() {
+			atomic.AddInt64(&running, 1)
+			<-gate
+		})
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&running) < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&running); n != 4 {
+		t.Fatalf("%d jobs running, want 4", n)
+	}
+	if s := pool.Statistics(); s.Workers != 4 || s.QueueLen != 2 {
+		t.Fatalf("%d workers, %d jobs queued, want 4 workers and 2 queued", s.Workers, s.QueueLen)
+	}
+
+	// workers above MinWorkers exit after WorkerIdleSecond
+	close(gate)
+	deadline = time.Now().Add(3 * time.Second)
+	for pool.Statistics().Workers > 1 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if s := pool.Statistics(); s.Workers != 1 || atomic.LoadInt64(&running) != 6 {
+		t.Fatalf("%d workers after idle, %d jobs ran, want 1 worker and 6 jobs", s.Workers, running)
+	}
+}
+
+func TestPoolOverflow(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		overflow int
+		ran      []int // jobs run once the queue drains, 0 is the job keeping the worker busy
+	}{
+		{"drop newest", PoolOverflowDropNewest, []int{0, 1, 2}},
+		{"drop oldest", PoolOverflowDropOldest, []int{0, 2, 3}},
+		{"run inline", PoolOverflowRunInline, []int{3, 0, 1, 2}},
+		{"block", PoolOverflowBlock, []int{0, 1, 2, 3}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := NewPoolWithConf(PoolConf{MinWorkers: 1, MaxWorkers: 1, QueueLen: 2, Overflow: tt.overflow})
+			defer pool.Release()
+
+			var mu sync.Mutex
+			var ran []int
+			job := func(i int) func() {
+				return func() {
+					mu.Lock()
+					ran = append(ran, i)
+					mu.Unlock()
+				}
+			}
+			started, gate := make(chan struct{}), make(chan struct{})
+			pool.SendJob(func() {
+				close(started)
+				<-gate
+				job(0)()
+			})
+			<-started
+			pool.SendJob(job(1))
+			pool.SendJob(job(2))
+
+			// the queue is full, the third job meets the overflow policy
+			sent := make(chan struct{})
+			go func() {
+				defer close(sent)
+				pool.SendJob(job(3))
+			}()
+			if tt.overflow == PoolOverflowBlock {
+				select {
+				case <-sent:
+					t.Fatal("send did not block on a full queue")
+				case <-time.After(50 * time.Millisecond):
+				}
+			} else {
+				<-sent
+			}
+			close(gate)
+			<-sent
+
+			var got string
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+				mu.Lock()
+				got = fmt.Sprint(ran)
+				n := len(ran)
+				mu.Unlock()
+				if n >= len(tt.ran) {
+					break
+				}
+			}
+			if want := fmt.Sprint(tt.ran); got != want {
+				t.Fatalf("ran jobs %s, want %s", got, want)
+			}
+			s := pool.Statistics()
+			stats := map[int]int64{
+				PoolOverflowDropNewest: s.DroppedNewest,
+				PoolOverflowDropOldest: s.DroppedOldest,
+				PoolOverflowRunInline:  s.RanInline,
+				PoolOverflowBlock:      s.Blocked,
+			}
+			if stats[tt.overflow] != 1 || s.DroppedNewest+s.DroppedOldest+s.RanInline+s.Blocked != 1 {
+				t.Fatalf("unexpected overflow statistics %+v", s)
+			}
+		})
+	}
+}
+
+func TestPoolPriority(t *testing.T) {
+	pool := NewPoolWithConf(PoolConf{MinWorkers: 1, MaxWorkers: 1, QueueLen: 16})
+	defer pool.Release()
+
+	var mu sync.Mutex
+	var ran []string
+	job := func(name string) func() {
+		return func() {
+			mu.Lock()
+			ran = append(ran, name)
+			mu.Unlock()
+		}
+	}
+	started, gate := make(chan struct{}), make(chan struct{})
+	pool.SendJob(func() {
+		close(started)
+		<-gate
+	})
+	<-started
+	// high priority jobs sent after the low ones run first
+	pool.SendJob(job("low1"))
+	pool.SendJob(job("low2"))
+	pool.SendJobWithPriority(job("high1"), PriorityHigh)
+	pool.SendJobWithPriority(job("high2"), PriorityHigh)
+	pool.SendJobWithPriority(job("low3"), PriorityLow)
+	close(gate)
+
+	var got string
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		mu.Lock()
+		got = fmt.Sprint(ran)
+		n := len(ran)
+		mu.Unlock()
+		if n == 5 {
+			break
+		}
+	}
+	if want := "[high1 high2 low1 low2 low3]"; got != want {
+		t.Fatalf("ran jobs %s, want %s", got, want)
+	}
+}
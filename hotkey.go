@@ -0,0 +1,103 @@
+package g2cache
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	HotKeyTrackerSize  = 4096 // distinct keys counted per window, Get of further keys is not counted, 0 disables tracking
+	HotKeyWindowSecond = 60   // HotKeys counts the current and the previous window
+)
+
+type HotKey struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// hotKeyTracker counts Get calls per key in fixed windows
+type hotKeyTracker struct {
+	mu   sync.RWMutex
+	cur  map[string]*int64
+	prev map[string]*int64
+}
+
+func newHotKeyTracker() *hotKeyTracker {
+	return &hotKeyTracker{
+		cur:  make(map[string]*int64),
+		prev: make(map[string]*int64),
+	}
+}
+
+func (h *hotKeyTracker) record(key string) {
+	if HotKeyTrackerSize <= 0 {
+		return
+	}
+	h.mu.RLock()
+	c, ok := h.cur[key]
+	h.mu.RUnlock()
+	if ok {
+		atomic.AddInt64(c, 1)
+		return
+	}
+	h.mu.Lock()
+	if c, ok = h.cur[key]; ok {
+		atomic.AddInt64(c, 1)
+	} else if len(h.cur) < HotKeyTrackerSize {
+		n := int64(1)
+		h.cur[key] = &n
+	}
+	h.mu.Unlock()
+}
+
+func (h *hotKeyTracker) roll() {
+	h.mu.Lock()
+	h.prev, h.cur = h.cur, make(map[string]*int64, len(h.cur))
+	h.mu.Unlock()
+}
+
+func (h *hotKeyTracker) top(n int) []HotKey {
+	h.mu.RLock()
+	counts := make(map[string]int64, len(h.cur)+len(h.prev))
+	for key, c := range h.prev {
+		counts[key] += atomic.LoadInt64(c)
+	}
+	for key, c := range h.cur {
+		counts[key] += atomic.LoadInt64(c)
+	}
+	h.mu.RUnlock()
+	keys := make([]HotKey, 0, len(counts))
+	for key, c := range counts {
+		keys = append(keys, HotKey{Key: key, Count: c})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if n > 0 && len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+func (g *G2Cache) rollHotKeys() {
+	t := g.clock.NewTicker(time.Duration(HotKeyWindowSecond) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-t.C():
+			g.hot.roll()
+		}
+	}
+}
+
+// HotKeys return the n most requested keys of the last one to two HotKeyWindowSecond, n <= 0 return all tracked keys
+func (g *G2Cache) HotKeys(n int) []HotKey {
+	return g.hot.top(n)
+}
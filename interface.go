@@ -3,7 +3,7 @@ package g2cache
 // Local memory cache，Local memory cache with high access speed
 type LocalCache interface {
 	Get(key string, obj interface{}) (*Entry, bool, error) // obj represents the internal structure of the real object
-	Set(key string, e *Entry) error                        // local storage should set Entry.Obsolete
+	Set(key string, e *Entry) error                        // local storage should set Entry.Obsolete, or Entry.Expiration plus StaleIfErrorSecond when it is set
 	Del(key string) error
 	ThreadSafe() // Need to ensure thread safety
 	Close()
@@ -24,18 +24,51 @@ type PubSub interface {
 	Publish(gid, key string, action int8, data *Entry) error
 }
 
-// Shouldn't throw a panic, please return an error
+// Optional, out storage writes a batch of Set and Del in one round trip
+type BatchOutCache interface {
+	Batch(metas []*ChannelMeta) error // ChannelMeta.Action is SetPublishType or DelPublishType
+}
+
+// Optional, pub sub publishes a batch of changes as one BatchPublishType message
+type BatchPubSub interface {
+	PublishBatch(gid string, metas []*ChannelMeta) error
+}
+
+// Optional, out storage replaces a value atomically. fn gets the current Entry, nil if missing, and return the new one,
+// it is called again with the new current Entry when another writer changed the key in between
+type CasOutCache interface {
+	CompareAndSwap(key string, obj interface{}, fn func(old *Entry) (*Entry, error)) (*Entry, error) // obj represents the internal structure of the real object
+}
+
+// Optional, out storage keeps integer counters, see G2Cache.Incr
+type CounterOutCache interface {
+	IncrBy(key string, delta int64) (int64, error) // return the value after the increment
+	GetCounter(key string) (int64, error)          // a missing counter is 0
+}
+
+// Optional, local storage lists its entries, Entry.Value is the encoded value. Used by the admin handler
+type RangeLocalCache interface {
+	Range(fn func(key string, e *Entry) bool) error // fn return false to stop
+}
+
+// Optional, out storage lists its keys by prefix. Used by the admin handler
+type ScanOutCache interface {
+	Scan(prefix string, fn func(key string) bool) error // fn return false to stop
+}
+
+// Shouldn't throw a panic, please return an error. A panic is recovered and returned as *LoaderPanicError
 type LoadDataSourceFunc func() (interface{}, error)
 
-// Entry expire is UnixNano
 const (
 	SetPublishType int8 = iota
 	DelPublishType
+	BatchPublishType
 )
 
 type ChannelMeta struct {
-	Key    string `json:"key"` // cache key
-	Gid    string `json:"gid"` // Used to identify working groups
-	Action int8   `json:"action"` // SetPublishType,DelPublishType
-	Data   *Entry `json:"data"`
+	Key    string         `json:"key"`    // cache key
+	Gid    string         `json:"gid"`    // Used to identify working groups
+	Action int8           `json:"action"` // SetPublishType,DelPublishType,BatchPublishType
+	Data   *Entry         `json:"data"`
+	Batch  []*ChannelMeta `json:"batch,omitempty"` // only BatchPublishType
 }
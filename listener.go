@@ -0,0 +1,130 @@
+package g2cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ListenerEventQueueLen = 1024 // events are dropped when listeners fall this far behind
+)
+
+// Listener receives cache events. Callbacks run in one dedicated goroutine, never on the request path,
+// so they should return quickly. Embed NopListener to implement only the callbacks of interest
+type Listener interface {
+	OnLocalHit(key string)
+	OnOutHit(key string)
+	OnLoad(key string, d time.Duration, err error) // data source load, err is nil on success
+	OnSet(key string)
+	OnDel(key string)
+	OnRemoteInvalidate(key string, action int8, gid string) // a change published by another instance
+	OnStaleRefresh(key string)                              // an obsolete local entry is refreshed in background
+}
+
+type NopListener struct{}
+
+func (NopListener) OnLocalHit(key string)                                  {}
+func (NopListener) OnOutHit(key string)                                    {}
+func (NopListener) OnLoad(key string, d time.Duration, err error)          {}
+func (NopListener) OnSet(key string)                                       {}
+func (NopListener) OnDel(key string)                                       {}
+func (NopListener) OnRemoteInvalidate(key string, action int8, gid string) {}
+func (NopListener) OnStaleRefresh(key string)                              {}
+
+const (
+	eventLocalHit int8 = iota
+	eventOutHit
+	eventLoad
+	eventSet
+	eventDel
+	eventRemoteInvalidate
+	eventStaleRefresh
+)
+
+type cacheEvent struct {
+	kind   int8
+	key    string
+	d      time.Duration
+	err    error
+	action int8
+	gid    string
+}
+
+type listenerHub struct {
+	mu        sync.RWMutex
+	listeners []Listener
+	n         int32 // len(listeners), read without lock on the request path
+	events    chan cacheEvent
+}
+
+func newListenerHub() *listenerHub {
+	return &listenerHub{
+		events: make(chan cacheEvent, ListenerEventQueueLen),
+	}
+}
+
+// AddListener registers l for cache events of this instance
+func (g *G2Cache) AddListener(l Listener) {
+	if l == nil {
+		return
+	}
+	h := g.listeners
+	h.mu.Lock()
+	h.listeners = append(h.listeners, l)
+	atomic.StoreInt32(&h.n, int32(len(h.listeners)))
+	h.mu.Unlock()
+}
+
+// emit never blocks, the event is dropped if the queue is full
+func (g *G2Cache) emit(ev cacheEvent) {
+	if atomic.LoadInt32(&g.listeners.n) == 0 {
+		return
+	}
+	select {
+	case g.listeners.events <- ev:
+	default:
+		atomic.AddInt64(&HitStatisticsOut.EventDropTotal, 1)
+	}
+}
+
+func (g *G2Cache) dispatchEvents() {
+	h := g.listeners
+	for {
+		select {
+		case <-g.stop:
+			return
+		case ev := <-h.events:
+			h.mu.RLock()
+			listeners := h.listeners
+			h.mu.RUnlock()
+			for _, l := range listeners {
+				dispatchEvent(l, ev)
+			}
+		}
+	}
+}
+
+func dispatchEvent(l Listener, ev cacheEvent) {
+	defer func() {
+		if err := recover(); err != nil {
+			LogErrW("listener panic", FieldKey(ev.key), Field("panic", err))
+		}
+	}()
+	switch ev.kind {
+	case eventLocalHit:
+		l.OnLocalHit(ev.key)
+	case eventOutHit:
+		l.OnOutHit(ev.key)
+	case eventLoad:
+		l.OnLoad(ev.key, ev.d, ev.err)
+	case eventSet:
+		l.OnSet(ev.key)
+	case eventDel:
+		l.OnDel(ev.key)
+	case eventRemoteInvalidate:
+		l.OnRemoteInvalidate(ev.key, ev.action, ev.gid)
+	case eventStaleRefresh:
+		l.OnStaleRefresh(ev.key)
+	}
+}
@@ -0,0 +1,186 @@
+package g2cache
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What a load does when its LoadLimit is exhausted
+const (
+	LoadLimitWait       int8 = iota // wait for the limit, up to LoadLimit.MaxWait
+	LoadLimitServeStale             // serve the stale value if there is one, otherwise wait
+	LoadLimitFailFast               // return DataSourceLoadLimited at once
+)
+
+// LoadLimit caps LoadDataSourceFunc calls of one instance, see WithLoadLimits
+type LoadLimit struct {
+	Prefix      string        // keys with this prefix, "" applies to every key
+	Rate        float64       // loads per second, 0 is unlimited
+	Burst       int           // loads allowed at once after being idle, at least 1
+	MaxInFlight int           // concurrent loads, 0 is unlimited
+	Policy      int8          // LoadLimitWait, LoadLimitServeStale or LoadLimitFailFast
+	MaxWait     time.Duration // a waiting load gives up with DataSourceLoadLimited after it, 0 waits until the cache is closed
+}
+
+// WithLoadLimits limits data source loads. A load passes the global limit with an empty Prefix,
+// and the limit with the longest Prefix of the key, each applies its own Policy
+func WithLoadLimits(limits ...LoadLimit) Option {
+	return func(g *G2Cache) {
+		for _, limit := range limits {
+			g.limiters = append(g.limiters, newLoadLimiter(limit))
+		}
+	}
+}
+
+type loadLimiter struct {
+	limit  LoadLimit
+	sem    chan struct{} // nil if MaxInFlight is unlimited
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newLoadLimiter(limit LoadLimit) *loadLimiter {
+	l := &loadLimiter{limit: limit}
+	if limit.MaxInFlight > 0 {
+		l.sem = make(chan struct{}, limit.MaxInFlight)
+	}
+	return l
+}
+
+// matchLimiters return the global limiter and the one with the longest prefix of key
+func (g *G2Cache) matchLimiters(key string) []*loadLimiter {
+	var global, prefix *loadLimiter
+	for _, l := range g.limiters {
+		if l.limit.Prefix == "" {
+			global = l
+			continue
+		}
+		if strings.HasPrefix(key, l.limit.Prefix) && (prefix == nil || len(l.limit.Prefix) > len(prefix.limit.Prefix)) {
+			prefix = l
+		}
+	}
+	var ls []*loadLimiter
+	if prefix != nil {
+		ls = append(ls, prefix)
+	}
+	if global != nil {
+		ls = append(ls, global)
+	}
+	return ls
+}
+
+// acquireLoad return the function that gives back the in-flight slots once the load is done
+func (g *G2Cache) acquireLoad(key string, hasStale bool) (release func(), err error) {
+	var acquired []*loadLimiter
+	release = func() {
+		for _, l := range acquired {
+			l.release()
+		}
+	}
+	for _, l := range g.matchLimiters(key) {
+		wait := l.limit.Policy == LoadLimitWait || (l.limit.Policy == LoadLimitServeStale && !hasStale)
+		if err = l.acquire(g, wait); err != nil {
+			release()
+			if err == DataSourceLoadLimited {
+				atomic.AddInt64(&HitStatisticsOut.LoadLimitedTotal, 1)
+				if CacheDebug {
+					LogDebugW("data source load limited", FieldKey(key), Field("prefix", l.limit.Prefix))
+				}
+			}
+			return nil, err
+		}
+		acquired = append(acquired, l)
+	}
+	return release, nil
+}
+
+func (l *loadLimiter) acquire(g *G2Cache, wait bool) error {
+	start := g.clock.Now()
+	if l.sem != nil {
+		if !wait {
+			select {
+			case l.sem <- struct{}{}:
+			default:
+				return DataSourceLoadLimited
+			}
+		} else {
+			var timeout <-chan time.Time
+			if l.limit.MaxWait > 0 {
+				var stop func()
+				timeout, stop = g.after(l.limit.MaxWait)
+				defer stop()
+			}
+			select {
+			case l.sem <- struct{}{}:
+			case <-timeout:
+				return DataSourceLoadLimited
+			case <-g.stop:
+				return CacheClose
+			}
+		}
+	}
+	if l.limit.Rate <= 0 {
+		return nil
+	}
+	maxWait := time.Duration(0)
+	if l.limit.MaxWait > 0 {
+		maxWait = l.limit.MaxWait - g.clock.Now().Sub(start)
+		if maxWait <= 0 {
+			l.release()
+			return DataSourceLoadLimited
+		}
+	}
+	d, ok := l.reserve(g.clock.Now(), wait, maxWait)
+	if !ok {
+		l.release()
+		return DataSourceLoadLimited
+	}
+	if !g.sleep(d) {
+		l.release()
+		return CacheClose
+	}
+	return nil
+}
+
+// reserve takes a token, a waiting caller may take one ahead and sleep the returned duration until it is refilled
+func (l *loadLimiter) reserve(now time.Time, wait bool, maxWait time.Duration) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	burst := float64(l.limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.limit.Rate
+		if l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+	if now.After(l.last) {
+		l.last = now
+	}
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	if !wait {
+		return 0, false
+	}
+	d := time.Duration((1 - l.tokens) / l.limit.Rate * float64(time.Second))
+	if maxWait > 0 && d > maxWait {
+		return 0, false
+	}
+	l.tokens--
+	return d, true
+}
+
+func (l *loadLimiter) release() {
+	if l.sem != nil {
+		<-l.sem
+	}
+}
@@ -0,0 +1,201 @@
+package g2cache
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	LoaderRetryMaxBackoff = 2 * time.Second // cap of the exponential backoff between loader retries
+)
+
+// LoaderPanicError is returned instead of propagating a panic of LoadDataSourceFunc
+type LoaderPanicError struct {
+	Key   string
+	Value interface{} // the recovered value
+	Stack []byte
+}
+
+func (e *LoaderPanicError) Error() string {
+	return fmt.Sprintf("key %s data source panic: %v", e.Key, e.Value)
+}
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// Retryable marks an error returned by LoadDataSourceFunc as worth retrying
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err}
+}
+
+// IsRetryable reports whether a loader error is retried: load timeouts, errors marked by Retryable,
+// and errors with a Temporary() method returning true, such as net.Error
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, DataSourceLoadTimeout) {
+		return true
+	}
+	var r *retryableError
+	if errors.As(err, &r) {
+		return true
+	}
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
+
+// WithDefaultLoaderTimeout bounds every LoadDataSourceFunc call, a call that times out returns DataSourceLoadTimeout
+// and releases the key lock, the abandoned fn keeps running until it returns. 0 means no timeout
+func WithDefaultLoaderTimeout(d time.Duration) Option {
+	return func(g *G2Cache) {
+		g.loaderTimeout = d
+	}
+}
+
+// WithDefaultLoaderRetry retries a failed load up to n times when IsRetryable, waiting backoff doubled on each retry with jitter
+func WithDefaultLoaderRetry(n int, backoff time.Duration) Option {
+	return func(g *G2Cache) {
+		g.loaderRetry = n
+		g.loaderBackoff = backoff
+	}
+}
+
+// WithLoaderTimeout overrides WithDefaultLoaderTimeout for one call
+func WithLoaderTimeout(d time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.loaderTimeout = d
+	}
+}
+
+// WithLoaderRetry overrides WithDefaultLoaderRetry for one call, n 0 disables retries
+func WithLoaderRetry(n int, backoff time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.loaderRetry = n
+		o.loaderBackoff = backoff
+		o.loaderRetrySet = true
+	}
+}
+
+// load calls the data source with timeout, retries and panic recovery, and return how long it took in total.
+// The caller passed the load limits with acquireLoad before taking the key lock, so a throttled load never holds the lock
+func (g *G2Cache) load(key string, fn LoadDataSourceFunc, co *callOptions) (interface{}, time.Duration, error) {
+	var err error
+
+	timeout, retry, backoff := g.loaderTimeout, g.loaderRetry, g.loaderBackoff
+	if co.loaderTimeout > 0 {
+		timeout = co.loaderTimeout
+	}
+	if co.loaderRetrySet {
+		retry, backoff = co.loaderRetry, co.loaderBackoff
+	}
+
+	start := g.clock.Now()
+	var o interface{}
+	for attempt := 0; ; attempt++ {
+		o, err = g.callLoader(key, fn, timeout)
+		if err == nil || attempt >= retry || !IsRetryable(err) {
+			break
+		}
+		atomic.AddInt64(&HitStatisticsOut.LoaderRetryTotal, 1)
+		if CacheDebug {
+			LogDebugW("data source load retry", FieldKey(key), Field("attempt", attempt+1), FieldErr(err))
+		}
+		if !g.sleep(retryBackoff(backoff, attempt)) {
+			break
+		}
+	}
+	d := g.clock.Now().Sub(start)
+	if err == nil && o != nil {
+		g.filterAdd(key)
+	}
+	g.emit(cacheEvent{kind: eventLoad, key: key, d: d, err: err})
+	return o, d, tierErr(key, TierSource, err)
+}
+
+func (g *G2Cache) callLoader(key string, fn LoadDataSourceFunc, timeout time.Duration) (interface{}, error) {
+	if timeout <= 0 {
+		return safeLoad(key, fn)
+	}
+	type result struct {
+		o   interface{}
+		err error
+	}
+	ch := make(chan result, 1) // never blocks the abandoned fn
+	go func() {
+		o, err := safeLoad(key, fn)
+		ch <- result{o: o, err: err}
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case r := <-ch:
+		return r.o, r.err
+	case <-t.C:
+		atomic.AddInt64(&HitStatisticsOut.LoaderTimeoutTotal, 1)
+		return nil, DataSourceLoadTimeout
+	}
+}
+
+func safeLoad(key string, fn LoadDataSourceFunc) (o interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&HitStatisticsOut.LoaderPanicTotal, 1)
+			LogErrW("data source panic", FieldKey(key), Field("panic", r))
+			o, err = nil, &LoaderPanicError{Key: key, Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return fn()
+}
+
+// retryBackoff is backoff doubled per attempt, capped by LoaderRetryMaxBackoff, with jitter in its upper half
+func retryBackoff(backoff time.Duration, attempt int) time.Duration {
+	if backoff <= 0 {
+		return 0
+	}
+	d := backoff
+	for i := 0; i < attempt && d < LoaderRetryMaxBackoff; i++ {
+		d *= 2
+	}
+	if LoaderRetryMaxBackoff > 0 && d > LoaderRetryMaxBackoff {
+		d = LoaderRetryMaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleep waits d by the clock of the cache, it return false if the cache was closed first
+func (g *G2Cache) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	c, stop := g.after(d)
+	defer stop()
+	select {
+	case <-g.stop:
+		return false
+	case <-c:
+		return true
+	}
+}
+
+// after is time.After by the clock of the cache, stop releases the ticker behind it
+func (g *G2Cache) after(d time.Duration) (<-chan time.Time, func()) {
+	t := g.clock.NewTicker(d)
+	return t.C(), t.Stop
+}
@@ -3,6 +3,8 @@ package g2cache
 import (
 	"github.com/coocood/freecache"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -13,16 +15,40 @@ type FreeCache struct {
 	storage  *freecache.Cache
 	stop     chan struct{}
 	stopOnce sync.Once
+	clock    atomic.Value // clockHolder
 }
 
 func NewFreeCache() *FreeCache {
 	f := &FreeCache{
-		storage: freecache.NewCache(DefaultFreeCacheSize),
-		stop:    make(chan struct{}, 1),
+		stop: make(chan struct{}, 1),
 	}
+	f.clock.Store(clockHolder{SystemClock})
+	f.storage = freecache.NewCacheCustomTimer(DefaultFreeCacheSize, freeCacheTimer{f})
 	return f
 }
 
+// SetClock implements ClockAware, freecache expires values by it too
+func (c *FreeCache) SetClock(clock Clock) {
+	c.clock.Store(clockHolder{clock})
+}
+
+func (c *FreeCache) now() time.Time {
+	return c.clock.Load().(clockHolder).Now()
+}
+
+// atomic.Value only stores values of one concrete type
+type clockHolder struct {
+	Clock
+}
+
+type freeCacheTimer struct {
+	c *FreeCache
+}
+
+func (t freeCacheTimer) Now() uint32 {
+	return uint32(t.c.now().Unix())
+}
+
 func (c *FreeCache) Set(key string, e *Entry) error {
 	select {
 	case <-c.stop:
@@ -30,9 +56,24 @@ func (c *FreeCache) Set(key string, e *Entry) error {
 	default:
 	}
 	s, _ := json.Marshal(e)
-	// local storage should set Obsolete time
-	obsolete := e.GetObsoleteTTL()
-	return c.storage.Set([]byte(key), s, int(obsolete))
+	// local storage should set Obsolete time, or Expiration plus the stale grace window
+	now := c.now()
+	ttl := e.ObsoleteTTLAt(now)
+	if StaleIfErrorSecond > 0 {
+		if keep := e.ExpireTTLAt(now) + time.Duration(StaleIfErrorSecond)*time.Second; keep > ttl {
+			ttl = keep
+		}
+	}
+	return c.storage.Set([]byte(key), s, freeCacheExpire(ttl))
+}
+
+// freeCacheExpire rounds ttl up to whole seconds, freecache never expires a value stored with 0
+func freeCacheExpire(ttl time.Duration) int {
+	second := int((ttl + time.Second - 1) / time.Second)
+	if second < 1 {
+		second = 1
+	}
+	return second
 }
 
 func (c *FreeCache) Del(key string) error {
@@ -67,6 +108,27 @@ func (c *FreeCache) Get(key string, obj interface{}) (*Entry, bool, error) {
 	return e, true, nil
 }
 
+// Range implements RangeLocalCache, it sees a consistent view of one freecache segment at a time
+func (c *FreeCache) Range(fn func(key string, e *Entry) bool) error {
+	select {
+	case <-c.stop:
+		return LocalStorageClose
+	default:
+	}
+	it := c.storage.NewIterator()
+	for fe := it.Next(); fe != nil; fe = it.Next() {
+		e := new(Entry)
+		e.Value = rawValue()
+		if err := json.Unmarshal(fe.Value, e); err != nil {
+			continue // not written by g2cache
+		}
+		if !fn(string(fe.Key), e) {
+			return nil
+		}
+	}
+	return nil
+}
+
 func (c *FreeCache) close() {
 	close(c.stop)
 	c.storage.Clear()
@@ -1,7 +1,11 @@
 package g2cache
 
 import (
+	"fmt"
 	"log"
+	"os"
+	"strings"
+	"sync"
 )
 
 // 外部调用者可实现此日志接口用于将日志导出
@@ -14,56 +18,272 @@ type LoggerInterface interface {
 	LogErrF(f string, s ...interface{})
 }
 
+type LogLevel int8
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	}
+	return "err"
+}
+
+// Storage tiers, used as the value of the tier log field
+const (
+	TierLocal  = "local"
+	TierOut    = "out"
+	TierSource = "source"
+)
+
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+func FieldKey(key string) LogField {
+	return LogField{Key: "key", Value: key}
+}
+
+func FieldTier(tier string) LogField {
+	return LogField{Key: "tier", Value: tier}
+}
+
+func FieldGid(gid string) LogField {
+	return LogField{Key: "gid", Value: gid}
+}
+
+func FieldErr(err error) LogField {
+	return LogField{Key: "error", Value: err}
+}
+
+func Field(key string, value interface{}) LogField {
+	return LogField{Key: key, Value: value}
+}
+
+// Optional, a Logger that implements WarnLogger gets warn records through LogWarn, other Loggers through LogErr
+type WarnLogger interface {
+	LogWarn(s ...interface{})
+}
+
+// 外部调用者可实现此结构化日志接口，未设置时结构化日志按 key=value 格式输出到 Logger
+type StructuredLogger interface {
+	Log(level LogLevel, msg string, fields ...LogField)
+}
+
+var (
+	Logger       LoggerInterface = &sysLogger{}
+	StructLogger StructuredLogger
+	// Records below this level are dropped, independent of CacheDebug which only controls hot path debug records
+	LogMinLevel = LogLevelDebug
+	// Each error message is logged at most LogErrRateLimitBurst times per LogErrRateLimitSecond, 0 disables
+	LogErrRateLimitSecond = 1
+	LogErrRateLimitBurst  = 10
+	// Colorize sysLogger output, by default only when stderr is a terminal
+	LogColor = isTerminal(os.Stderr)
+)
+
 func LogInfoF(f string, s ...interface{}) {
-	Logger.LogInfoF(f, s)
+	if LogMinLevel <= LogLevelInfo {
+		Logger.LogInfoF(f, s...)
+	}
 }
 
 func LogInfo(s ...interface{}) {
-	Logger.LogInfo(s)
+	if LogMinLevel <= LogLevelInfo {
+		Logger.LogInfo(s...)
+	}
 }
 
 func LogDebug(s ...interface{}) {
-	Logger.LogDebug(s)
+	if LogMinLevel <= LogLevelDebug {
+		Logger.LogDebug(s...)
+	}
 }
 
 func LogDebugF(f string, s ...interface{}) {
-	Logger.LogDebugF(f, s)
+	if LogMinLevel <= LogLevelDebug {
+		Logger.LogDebugF(f, s...)
+	}
 }
 
 func LogErr(s ...interface{}) {
-	Logger.LogErr(s)
+	Logger.LogErr(s...)
 }
 
 func LogErrF(f string, s ...interface{}) {
-	Logger.LogErrF(f, s)
+	Logger.LogErrF(f, s...)
+}
+
+func LogDebugW(msg string, fields ...LogField) {
+	logW(LogLevelDebug, msg, fields)
+}
+
+func LogInfoW(msg string, fields ...LogField) {
+	logW(LogLevelInfo, msg, fields)
+}
+
+func LogWarnW(msg string, fields ...LogField) {
+	logW(LogLevelWarn, msg, fields)
+}
+
+// LogErrW is rate limited per msg, so msg should be a constant and variable parts go to fields
+func LogErrW(msg string, fields ...LogField) {
+	logW(LogLevelError, msg, fields)
+}
+
+func logW(level LogLevel, msg string, fields []LogField) {
+	if level < LogMinLevel {
+		return
+	}
+	if level >= LogLevelWarn {
+		allow, suppressed := errLimiter.allow(msg)
+		if !allow {
+			return
+		}
+		if suppressed > 0 {
+			fields = append(fields, Field("suppressed", suppressed))
+		}
+	}
+	if StructLogger != nil {
+		StructLogger.Log(level, msg, fields...)
+		return
+	}
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, f := range fields {
+		b.WriteString(" ")
+		b.WriteString(f.Key)
+		b.WriteString("=")
+		b.WriteString(fmt.Sprint(f.Value))
+	}
+	switch level {
+	case LogLevelDebug:
+		Logger.LogDebug(b.String())
+	case LogLevelInfo:
+		Logger.LogInfo(b.String())
+	case LogLevelWarn:
+		if w, ok := Logger.(WarnLogger); ok {
+			w.LogWarn(b.String())
+			return
+		}
+		Logger.LogErr(b.String())
+	default:
+		Logger.LogErr(b.String())
+	}
+}
+
+// logRateLimiter drops repeated messages from hot paths, and counts what it dropped
+type logRateLimiter struct {
+	mu      sync.Mutex
+	clock   Clock
+	windows map[string]*logWindow
+}
+
+type logWindow struct {
+	start      int64
+	count      int
+	suppressed int
+}
+
+var errLimiter = &logRateLimiter{clock: SystemClock, windows: make(map[string]*logWindow)}
+
+// SetLogClock replaces the time source of the error log rate limit and starts all windows over, nil restores SystemClock
+func SetLogClock(c Clock) {
+	if c == nil {
+		c = SystemClock
+	}
+	errLimiter.mu.Lock()
+	defer errLimiter.mu.Unlock()
+	errLimiter.clock = c
+	errLimiter.windows = make(map[string]*logWindow)
+}
+
+func (l *logRateLimiter) allow(msg string) (bool, int) {
+	if LogErrRateLimitSecond <= 0 || LogErrRateLimitBurst <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now().Unix()
+	w, ok := l.windows[msg]
+	if !ok || now-w.start >= int64(LogErrRateLimitSecond) {
+		suppressed := 0
+		if ok {
+			suppressed = w.suppressed
+		}
+		if len(l.windows) >= 1024 {
+			l.windows = make(map[string]*logWindow)
+		}
+		l.windows[msg] = &logWindow{start: now, count: 1}
+		return true, suppressed
+	}
+	if w.count >= LogErrRateLimitBurst {
+		w.suppressed++
+		return false, 0
+	}
+	w.count++
+	return true, 0
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
 }
 
 type sysLogger struct{}
 
-var (
-	Logger LoggerInterface = &sysLogger{}
-)
+func (l *sysLogger) prefix(level LogLevel) string {
+	if !LogColor {
+		return "[g2cache] [" + level.String() + "] "
+	}
+	color := "32"
+	switch level {
+	case LogLevelDebug:
+		color = "33"
+	case LogLevelWarn, LogLevelError:
+		color = "31"
+	}
+	return "[\u001B[32mg2cache\u001B[0m] [\u001B[" + color + "m" + level.String() + "\u001B[0m] "
+}
 
 func (l *sysLogger) LogInfo(s ...interface{}) {
-	log.Println("[\u001B[32mg2cache\u001B[0m] [\u001B[32minfo\u001B[0m] ", s)
+	log.Println(append([]interface{}{l.prefix(LogLevelInfo)}, s...)...)
 }
 
 func (l *sysLogger) LogInfoF(f string, s ...interface{}) {
-	log.Printf("[\u001B[32mg2cache\u001B[0m] [\u001B[32minfo\u001B[0m] "+f, s)
+	log.Printf(l.prefix(LogLevelInfo)+f, s...)
 }
 
 func (l *sysLogger) LogDebug(s ...interface{}) {
-	log.Println("[\u001B[32mg2cache\u001B[0m] [\u001B[33mdebug\u001B[0m] ", s)
+	log.Println(append([]interface{}{l.prefix(LogLevelDebug)}, s...)...)
 }
 
 func (l *sysLogger) LogDebugF(f string, s ...interface{}) {
-	log.Printf("[\u001B[32mg2cache\u001B[0m] [\u001B[33mdebug\u001B[0m] "+f, s)
+	log.Printf(l.prefix(LogLevelDebug)+f, s...)
+}
+
+func (l *sysLogger) LogWarn(s ...interface{}) {
+	log.Println(append([]interface{}{l.prefix(LogLevelWarn)}, s...)...)
 }
 
 func (l *sysLogger) LogErr(s ...interface{}) {
-	log.Println("[\u001B[32mg2cache\u001B[0m] [\u001B[31merr\u001B[0m] ", s)
+	log.Println(append([]interface{}{l.prefix(LogLevelError)}, s...)...)
 }
 
 func (l *sysLogger) LogErrF(f string, s ...interface{}) {
-	log.Printf("[\u001B[32mg2cache\u001B[0m] [\u001B[31merr\u001B[0m] "+f, s)
+	log.Printf(l.prefix(LogLevelError)+f, s...)
 }
@@ -0,0 +1,46 @@
+package g2cache
+
+import (
+	"context"
+	"log/slog"
+)
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger adapts a log/slog logger, assign it to StructLogger
+func NewSlogLogger(l *slog.Logger) StructuredLogger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &slogLogger{l: l.With(slog.String("logger", "g2cache"))}
+}
+
+func (s *slogLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	lv := slogLevel(level)
+	if !s.l.Enabled(context.Background(), lv) {
+		return
+	}
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, f := range fields {
+		if err, ok := f.Value.(error); ok && err != nil {
+			attrs = append(attrs, slog.String(f.Key, err.Error()))
+			continue
+		}
+		attrs = append(attrs, slog.Any(f.Key, f.Value))
+	}
+	s.l.LogAttrs(context.Background(), lv, msg, attrs...)
+}
+
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case LogLevelDebug:
+		return slog.LevelDebug
+	case LogLevelInfo:
+		return slog.LevelInfo
+	case LogLevelWarn:
+		return slog.LevelWarn
+	}
+	return slog.LevelError
+}
@@ -0,0 +1,113 @@
+package g2cache
+
+import (
+	"time"
+)
+
+// Option configures a G2Cache in New
+type Option func(*G2Cache)
+
+// WithClock replaces SystemClock, local and out storage implementing ClockAware follow it too
+func WithClock(c Clock) Option {
+	return func(g *G2Cache) {
+		if c != nil {
+			g.clock = c
+		}
+	}
+}
+
+// CallOption tunes a single Get, GetWithInfo, Set or Del call
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	forceRefresh bool
+	localOnly    bool
+	outOnly      bool
+	noPublish    bool
+	stale        time.Duration // Entry.Obsolete
+	hard         time.Duration // Entry.Expiration
+	// loader overrides, see WithLoaderTimeout and WithLoaderRetry
+	loaderTimeout  time.Duration
+	loaderRetry    int
+	loaderBackoff  time.Duration
+	loaderRetrySet bool
+}
+
+func newCallOptions(ttl time.Duration, opts []CallOption) *callOptions {
+	o := &callOptions{}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(o)
+		}
+	}
+	if o.stale <= 0 {
+		o.stale = ttl
+	}
+	if o.hard <= 0 {
+		o.hard = o.stale * time.Duration(EntryLazyFactor)
+	}
+	if o.hard < o.stale {
+		o.hard = o.stale
+	}
+	return o
+}
+
+func (o *callOptions) newEntry(v interface{}, now time.Time) *Entry {
+	return NewEntryAt(v, o.stale, o.hard, now)
+}
+
+func (o *callOptions) useLocal() bool {
+	return !o.outOnly
+}
+
+func (o *callOptions) useOut() bool {
+	return !o.localOnly
+}
+
+func (o *callOptions) publish() bool {
+	return !o.localOnly && !o.noPublish
+}
+
+// WithForceRefresh Get bypasses both storages and reloads from the data source, then stores the result as usual
+func WithForceRefresh() CallOption {
+	return func(o *callOptions) {
+		o.forceRefresh = true
+	}
+}
+
+// WithLocalOnly the call only reads and writes local storage, nothing is published
+func WithLocalOnly() CallOption {
+	return func(o *callOptions) {
+		o.localOnly = true
+		o.outOnly = false
+	}
+}
+
+// WithOutOnly the call only reads and writes out storage
+func WithOutOnly() CallOption {
+	return func(o *callOptions) {
+		o.outOnly = true
+		o.localOnly = false
+	}
+}
+
+// WithStaleTTL the stored value is obsolete after d, instead of ttl
+func WithStaleTTL(d time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.stale = d
+	}
+}
+
+// WithHardTTL the stored value expires after d, instead of the stale ttl multiplied by EntryLazyFactor
+func WithHardTTL(d time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.hard = d
+	}
+}
+
+// WithNoPublish changes made by the call are not published to other instances
+func WithNoPublish() CallOption {
+	return func(o *callOptions) {
+		o.noPublish = true
+	}
+}
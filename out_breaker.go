@@ -0,0 +1,300 @@
+package g2cache
+
+import (
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	OutCacheBreakerThreshold   = 5    // consecutive out storage failures that open the breaker, 0 disables the breaker
+	OutCacheBreakerProbeSecond = 3    // an open breaker probes the out storage at this interval
+	OutCacheBreakerPendingDel  = 1024 // max keys whose out storage delete is queued while the breaker is open, further writes are dropped
+)
+
+const (
+	BreakerClosed int32 = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+// Optional, out storage health check used by the breaker probe.
+// Without it an open breaker lets a single real request through after each probe interval
+type Pinger interface {
+	Ping() error
+}
+
+// outBreaker skips the out storage after consecutive failures, so that Get degrades to local storage and data source
+type outBreaker struct {
+	state    int32
+	failures int32
+	openedAt int64 // unix second
+	trial    int32 // a request is on trial while half open
+	mu       sync.Mutex
+	pending  map[string]struct{} // out storage deletes queued while open
+	clock    Clock
+}
+
+func newOutBreaker(clock Clock) *outBreaker {
+	return &outBreaker{
+		pending: make(map[string]struct{}),
+		clock:   clock,
+	}
+}
+
+func (b *outBreaker) enabled() bool {
+	return OutCacheBreakerThreshold > 0
+}
+
+func (b *outBreaker) State() int32 {
+	return atomic.LoadInt32(&b.state)
+}
+
+// allow reports whether a request may reach the out storage
+func (b *outBreaker) allow() bool {
+	if !b.enabled() {
+		return true
+	}
+	switch atomic.LoadInt32(&b.state) {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		return atomic.CompareAndSwapInt32(&b.trial, 0, 1)
+	}
+	return false
+}
+
+// done records the result of a request that reached the out storage, it return true if the breaker was just closed
+func (b *outBreaker) done(err error) bool {
+	if !b.enabled() {
+		return false
+	}
+	if err != nil && isOutUnavailable(err) {
+		if atomic.AddInt32(&b.failures, 1) >= int32(OutCacheBreakerThreshold) || atomic.LoadInt32(&b.state) == BreakerHalfOpen {
+			b.open()
+		}
+		return false
+	}
+	atomic.StoreInt32(&b.failures, 0)
+	if atomic.CompareAndSwapInt32(&b.state, BreakerHalfOpen, BreakerClosed) {
+		atomic.StoreInt32(&b.trial, 0)
+		return true
+	}
+	return false
+}
+
+func (b *outBreaker) open() {
+	atomic.StoreInt64(&b.openedAt, b.clock.Now().Unix())
+	atomic.StoreInt32(&b.trial, 0)
+	if atomic.SwapInt32(&b.state, BreakerOpen) != BreakerOpen {
+		atomic.AddInt64(&HitStatisticsOut.OutBreakerOpenTotal, 1)
+		LogWarnW("out storage breaker open", FieldTier(TierOut), Field("failures", atomic.LoadInt32(&b.failures)))
+	}
+}
+
+func (b *outBreaker) close() bool {
+	atomic.StoreInt32(&b.failures, 0)
+	atomic.StoreInt32(&b.trial, 0)
+	return atomic.SwapInt32(&b.state, BreakerClosed) != BreakerClosed
+}
+
+// halfOpen lets the next request through after the probe interval has passed
+func (b *outBreaker) halfOpen() {
+	if b.clock.Now().Unix()-atomic.LoadInt64(&b.openedAt) < int64(OutCacheBreakerProbeSecond) {
+		return
+	}
+	atomic.CompareAndSwapInt32(&b.state, BreakerOpen, BreakerHalfOpen)
+}
+
+func (b *outBreaker) drop() {
+	atomic.AddInt64(&HitStatisticsOut.OutWriteDropTotal, 1)
+}
+
+func (b *outBreaker) queueDel(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.pending) >= OutCacheBreakerPendingDel {
+		b.drop()
+		return
+	}
+	b.pending[key] = struct{}{}
+}
+
+// takePending return and clear the keys whose delete was queued while open
+func (b *outBreaker) takePending() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := make([]string, 0, len(b.pending))
+	for k := range b.pending {
+		keys = append(keys, k)
+	}
+	b.pending = make(map[string]struct{})
+	return keys
+}
+
+// Connection level failures open the breaker, data errors such as decode failures do not
+func isOutUnavailable(err error) bool {
+	if err == nil || errors.Is(err, OutStorageClose) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, redis.ErrPoolExhausted)
+}
+
+func (g *G2Cache) breakerProbe() {
+	t := g.clock.NewTicker(time.Duration(OutCacheBreakerProbeSecond) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-t.C():
+			if g.breaker.State() != BreakerOpen {
+				continue
+			}
+			pinger, ok := g.out.(Pinger)
+			if !ok {
+				g.breaker.halfOpen()
+				continue
+			}
+			if err := pinger.Ping(); err != nil {
+				if CacheDebug {
+					LogDebugW("out storage breaker probe failed", FieldTier(TierOut), FieldErr(err))
+				}
+				continue
+			}
+			if g.breaker.close() {
+				g.breakerClosed()
+			}
+		}
+	}
+}
+
+// breakerClosed replays the out storage deletes queued while the breaker was open, and publishes them,
+// in the key lanes so that they are ordered with async writes of the same key
+func (g *G2Cache) breakerClosed() {
+	LogInfoW("out storage breaker closed", FieldTier(TierOut))
+	for _, key := range g.breaker.takePending() {
+		key := key
+		g.gPool.SendKeyJob(key, func() {
+			if err := g.outDel(key); err != nil {
+				LogErrW("breaker replay del failed", FieldKey(key), FieldTier(TierOut), FieldErr(err))
+				return
+			}
+			if err := g.publish(key, DelPublishType, nil); err != nil {
+				LogErrW("breaker replay publish failed", FieldKey(key), FieldTier(TierOut), FieldErr(err))
+			}
+		})
+	}
+}
+
+// OutBreakerState return BreakerClosed, BreakerOpen or BreakerHalfOpen
+func (g *G2Cache) OutBreakerState() int32 {
+	return g.breaker.State()
+}
+
+func (g *G2Cache) outGet(key string, obj interface{}) (*Entry, bool, error) {
+	if !g.breaker.allow() {
+		return nil, false, nil
+	}
+	e, ok, err := g.out.Get(key, obj)
+	if g.breaker.done(err) {
+		g.breakerClosed()
+	}
+	return e, ok, tierErr(key, TierOut, err)
+}
+
+// out storage writes become queued deletes while the breaker is open, so that the old value is not served after it closes
+func (g *G2Cache) outSet(key string, e *Entry) error {
+	if !g.breaker.allow() {
+		g.breaker.queueDel(key)
+		return nil
+	}
+	err := g.out.Set(key, e)
+	if g.breaker.done(err) {
+		g.breakerClosed()
+	}
+	return tierErr(key, TierOut, err)
+}
+
+// out storage deletes are queued while the breaker is open
+func (g *G2Cache) outDel(key string) error {
+	if !g.breaker.allow() {
+		g.breaker.queueDel(key)
+		return nil
+	}
+	err := g.out.Del(key)
+	if g.breaker.done(err) {
+		g.breakerClosed()
+	}
+	return tierErr(key, TierOut, err)
+}
+
+// out storage updates fail fast while the breaker is open
+func (g *G2Cache) outUpdate(key string, obj interface{}, fn func(old *Entry) (*Entry, error)) (*Entry, error) {
+	cas, ok := g.out.(CasOutCache)
+	if !ok {
+		return nil, OutStorageNotImplementCas
+	}
+	if !g.breaker.allow() {
+		return nil, tierErr(key, TierOut, OutStorageUnavailable)
+	}
+	e, err := cas.CompareAndSwap(key, obj, fn)
+	if g.breaker.done(err) {
+		g.breakerClosed()
+	}
+	return e, tierErr(key, TierOut, err)
+}
+
+// out storage counters fail fast while the breaker is open
+func (g *G2Cache) outIncrBy(key string, delta int64) (int64, error) {
+	counter, ok := g.out.(CounterOutCache)
+	if !ok {
+		return 0, OutStorageNotImplementCounter
+	}
+	if !g.breaker.allow() {
+		return 0, tierErr(key, TierOut, OutStorageUnavailable)
+	}
+	v, err := counter.IncrBy(key, delta)
+	if g.breaker.done(err) {
+		g.breakerClosed()
+	}
+	return v, tierErr(key, TierOut, err)
+}
+
+func (g *G2Cache) outGetCounter(key string) (int64, error) {
+	counter, ok := g.out.(CounterOutCache)
+	if !ok {
+		return 0, OutStorageNotImplementCounter
+	}
+	if !g.breaker.allow() {
+		return 0, tierErr(key, TierOut, OutStorageUnavailable)
+	}
+	v, err := counter.GetCounter(key)
+	if g.breaker.done(err) {
+		g.breakerClosed()
+	}
+	return v, tierErr(key, TierOut, err)
+}
+
+func (g *G2Cache) publish(key string, action int8, e *Entry) error {
+	pubsub, ok := g.out.(PubSub)
+	if !ok || !OutCachePubSub {
+		return nil
+	}
+	if !g.breaker.allow() {
+		return nil
+	}
+	err := pubsub.Publish(g.GID, key, action, e)
+	if g.breaker.done(err) {
+		g.breakerClosed()
+	}
+	return tierErr(key, TierOut, err)
+}
@@ -3,7 +3,10 @@ package g2cache
 import (
 	"fmt"
 	"github.com/gomodule/redigo/redis"
+	"github.com/mohae/deepcopy"
+	"strings"
 	"sync"
+	"time"
 )
 
 var DefaultPubSubRedisChannel = "g2cache-pubsub-channel"
@@ -21,6 +24,9 @@ type RedisCache struct {
 	pubsubPool *redis.Pool
 	stop       chan struct{}
 	stopOnce   sync.Once
+	pscMu      sync.Mutex
+	psc        *redis.PubSubConn // closed by Close to unblock Subscribe
+	clock      Clock
 }
 
 type RedisConf struct {
@@ -48,6 +54,7 @@ func NewRedisCache() (*RedisCache, error) {
 		pool:       pool,
 		pubsubPool: pubsubPool,
 		stop:       make(chan struct{}, 1),
+		clock:      SystemClock,
 	}
 	return c, nil
 }
@@ -67,7 +74,15 @@ func (r *RedisCache) Close() {
 
 func (r *RedisCache) close() {
 	close(r.stop)
+	r.pscMu.Lock()
+	if r.psc != nil {
+		r.psc.Close()
+	}
+	r.pscMu.Unlock()
 	r.pool.Close()
+	if r.pubsubPool != nil {
+		r.pubsubPool.Close()
+	}
 }
 
 func (r *RedisCache) Set(key string, obj *Entry) error {
@@ -80,9 +95,54 @@ func (r *RedisCache) Set(key string, obj *Entry) error {
 	if err != nil {
 		return err
 	}
-	// out storage should set Expiration time
-	rdsTtl := obj.GetExpireTTL()
-	return RedisSetString(key, str, int(rdsTtl), r.pool)
+	return RedisPSetString(key, str, r.ttl(obj), r.pool)
+}
+
+// out storage should set Expiration time, keep the stale grace window for StaleIfErrorSecond, it returns milliseconds
+func (r *RedisCache) ttl(e *Entry) int64 {
+	rdsTtl := e.ExpireTTLAt(r.clock.Now())
+	if StaleIfErrorSecond > 0 {
+		rdsTtl += time.Duration(StaleIfErrorSecond) * time.Second
+	}
+	if ms := durationMs(rdsTtl); ms > 0 {
+		return ms
+	}
+	return 1
+}
+
+// SetClock implements ClockAware, it is called by New before the cache is used
+func (r *RedisCache) SetClock(clock Clock) {
+	r.clock = clock
+}
+
+func (r *RedisCache) Batch(metas []*ChannelMeta) error {
+	select {
+	case <-r.stop:
+		return OutStorageClose
+	default:
+	}
+	cmds := make([]RedisCmd, 0, len(metas))
+	for _, meta := range metas {
+		if meta.Action == DelPublishType {
+			cmds = append(cmds, RedisCmd{Name: "DEL", Args: []interface{}{meta.Key}})
+			continue
+		}
+		str, err := json.MarshalToString(meta.Data)
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, RedisCmd{Name: "PSETEX", Args: []interface{}{meta.Key, r.ttl(meta.Data), str}})
+	}
+	return RedisPipeline(cmds, r.pool)
+}
+
+func (r *RedisCache) Ping() error {
+	select {
+	case <-r.stop:
+		return OutStorageClose
+	default:
+	}
+	return RedisPing(r.pool)
 }
 
 func (r *RedisCache) DistributedEnable() bool {
@@ -96,15 +156,30 @@ func (r *RedisCache) Subscribe(ch chan<- *ChannelMeta) error {
 	default:
 	}
 	conn := r.pubsubPool.Get()
-	defer conn.Close()
+	psc := &redis.PubSubConn{Conn: conn}
+	r.pscMu.Lock()
+	select {
+	case <-r.stop:
+		r.pscMu.Unlock()
+		conn.Close()
+		return OutStorageClose
+	default:
+	}
+	r.psc = psc
+	r.pscMu.Unlock()
+	defer func() {
+		r.pscMu.Lock()
+		r.psc = nil
+		r.pscMu.Unlock()
+		conn.Close()
+	}()
 
-	psc := redis.PubSubConn{Conn: conn}
 	if err := psc.Subscribe(DefaultPubSubRedisChannel); err != nil {
-		LogErrF("rds subscribe channel=%v, err=%v\n", DefaultPubSubRedisChannel, err)
+		LogErrW("rds subscribe failed", Field("channel", DefaultPubSubRedisChannel), FieldErr(err))
 		return err
 	}
 	if CacheDebug {
-		LogDebugF("rds subscribe channel=%v start ...\n", DefaultPubSubRedisChannel)
+		LogDebugW("rds subscribe start", Field("channel", DefaultPubSubRedisChannel))
 	}
 
 LOOP:
@@ -118,18 +193,22 @@ LOOP:
 		case redis.Message:
 			meta := &ChannelMeta{}
 			err := json.Unmarshal(v.Data, meta)
-			if err != nil || meta.Key == "" {
-				LogErrF("rds subscribe Unmarshal data: %+v,err:%v\n", v.Data, err)
+			if err != nil || (meta.Key == "" && meta.Action != BatchPublishType) {
+				LogErrW("rds subscribe unmarshal failed", Field("data", string(v.Data)), FieldErr(err))
 				continue
 			}
 			select {
 			case <-r.stop:
 				return OutStorageClose
-			default:
+			case ch <- meta:
 			}
-			ch <- meta
 		case error:
-			LogErrF("rds subscribe receive error, msg=%v\n", v)
+			select {
+			case <-r.stop:
+				return OutStorageClose
+			default:
+			}
+			LogErrW("rds subscribe receive failed", Field("channel", DefaultPubSubRedisChannel), FieldErr(v))
 			break LOOP
 		}
 	}
@@ -162,6 +241,112 @@ func (r *RedisCache) Get(key string, obj interface{}) (*Entry, bool, error) {
 	return &e, true, err
 }
 
+// CompareAndSwap implements CasOutCache with WATCH and MULTI, it retries UpdateMaxRetry times on conflict
+func (r *RedisCache) CompareAndSwap(key string, obj interface{}, fn func(old *Entry) (*Entry, error)) (*Entry, error) {
+	select {
+	case <-r.stop:
+		return nil, OutStorageClose
+	default:
+	}
+	conn, err := getRedisConn(r.pool)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	for i := 0; i < UpdateMaxRetry; i++ {
+		if _, err = conn.Do("WATCH", key); err != nil {
+			return nil, err
+		}
+		e, err := r.casSwap(conn, key, deepcopy.Copy(obj), fn) // each attempt decodes into its own copy
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		str, err := json.MarshalToString(e)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		if err = conn.Send("MULTI"); err != nil {
+			return nil, err
+		}
+		if err = conn.Send("PSETEX", key, r.ttl(e), str); err != nil {
+			return nil, err
+		}
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if reply != nil {
+			return e, nil
+		}
+		// the key changed after WATCH
+	}
+	return nil, UpdateConflict
+}
+
+func (r *RedisCache) casSwap(conn redis.Conn, key string, obj interface{}, fn func(old *Entry) (*Entry, error)) (*Entry, error) {
+	str, err := redis.String(conn.Do("GET", key))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	if str == "" {
+		return fn(nil)
+	}
+	old := new(Entry)
+	old.Value = obj // Save the reflection structure of obj
+	if err = json.UnmarshalFromString(str, old); err != nil {
+		return nil, err
+	}
+	return fn(old)
+}
+
+// IncrBy implements CounterOutCache
+func (r *RedisCache) IncrBy(key string, delta int64) (int64, error) {
+	select {
+	case <-r.stop:
+		return 0, OutStorageClose
+	default:
+	}
+	return RedisIncrBy(key, delta, r.pool)
+}
+
+// GetCounter implements CounterOutCache
+func (r *RedisCache) GetCounter(key string) (int64, error) {
+	select {
+	case <-r.stop:
+		return 0, OutStorageClose
+	default:
+	}
+	v, err := RedisGetInt64(key, r.pool)
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return v, err
+}
+
+// Scan implements ScanOutCache with SCAN, keys may be reported more than once
+func (r *RedisCache) Scan(prefix string, fn func(key string) bool) error {
+	select {
+	case <-r.stop:
+		return OutStorageClose
+	default:
+	}
+	return RedisScan(redisGlobEscape(prefix)+"*", r.pool, fn)
+}
+
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
 func (r *RedisCache) Publish(gid, key string, action int8, value *Entry) error {
 	select {
 	case <-r.stop:
@@ -181,4 +366,22 @@ func (r *RedisCache) Publish(gid, key string, action int8, value *Entry) error {
 	return RedisPublish(DefaultPubSubRedisChannel, s, r.pubsubPool)
 }
 
+func (r *RedisCache) PublishBatch(gid string, metas []*ChannelMeta) error {
+	select {
+	case <-r.stop:
+		return OutStorageClose
+	default:
+	}
+	meta := ChannelMeta{
+		Gid:    gid,
+		Action: BatchPublishType,
+		Batch:  metas,
+	}
+	s, err := json.MarshalToString(meta)
+	if err != nil {
+		return err
+	}
+	return RedisPublish(DefaultPubSubRedisChannel, s, r.pubsubPool)
+}
+
 func (r *RedisCache) ThreadSafe() {}
@@ -0,0 +1,70 @@
+package g2cache
+
+// Peek fills obj with the cached value of key from local storage, then out storage.
+// Unlike Get it never loads from the data source, refreshes an obsolete value or fills local storage, and it does not count as an access.
+// ok is false if neither storage has an unexpired value
+func (g *G2Cache) Peek(key string, obj interface{}, opts ...CallOption) (ok bool, err error) {
+	defer func() {
+		err = withOp(OpPeek, err)
+	}()
+	select {
+	case <-g.stop:
+		return false, CacheClose
+	default:
+	}
+	if key == "" {
+		return false, CacheKeyEmpty
+	}
+	if obj == nil {
+		return false, CacheObjNil
+	}
+	co := newCallOptions(0, opts)
+	var e *Entry
+	tier := TierLocal
+	if co.useLocal() {
+		e, ok, err = g.localGet(key, obj)
+		if err != nil {
+			return false, err
+		}
+		ok = ok && !e.ExpiredAt(g.clock.Now())
+	}
+	if !ok && co.useOut() {
+		tier = TierOut
+		e, ok, err = g.outGet(key, obj)
+		if err != nil {
+			return false, err
+		}
+		ok = ok && !e.ExpiredAt(g.clock.Now())
+	}
+	if !ok {
+		return false, nil
+	}
+	return true, tierErr(key, tier, clone(e.Value, obj))
+}
+
+// Exists reports which storages hold an unexpired value of key, without decoding it into a typed object
+func (g *G2Cache) Exists(key string) (local, out bool, err error) {
+	defer func() {
+		err = withOp(OpExists, err)
+	}()
+	select {
+	case <-g.stop:
+		return false, false, CacheClose
+	default:
+	}
+	if key == "" {
+		return false, false, CacheKeyEmpty
+	}
+	now := g.clock.Now()
+	e, ok, err := g.localGet(key, rawValue())
+	if err != nil {
+		return false, false, err
+	}
+	local = ok && !e.ExpiredAt(now)
+	e, ok, err = g.outGet(key, rawValue())
+	if err != nil {
+		return local, false, err
+	}
+	out = ok && !e.ExpiredAt(now)
+	return local, out, nil
+}
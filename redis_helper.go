@@ -25,6 +25,67 @@ func RedisSetString(key, value string, ttl int, pool *redis.Pool) error {
 	return err
 }
 
+// RedisPSetString ttl is milliseconds
+func RedisPSetString(key, value string, ttl int64, pool *redis.Pool) error {
+	conn, err := getRedisConn(pool)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("PSETEX", key, ttl, value)
+	return err
+}
+
+func RedisIncrBy(key string, delta int64, pool *redis.Pool) (int64, error) {
+	conn, err := getRedisConn(pool)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return redis.Int64(conn.Do("INCRBY", key, delta))
+}
+
+func RedisGetInt64(key string, pool *redis.Pool) (int64, error) {
+	conn, err := getRedisConn(pool)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return redis.Int64(conn.Do("GET", key))
+}
+
+// RedisScan calls fn for the keys matching pattern until fn return false
+func RedisScan(pattern string, pool *redis.Pool, fn func(key string) bool) error {
+	conn, err := getRedisConn(pool)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		cursor, err = redis.Int(values[0], nil)
+		if err != nil {
+			return err
+		}
+		keys, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if !fn(key) {
+				return nil
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
 func RedisGetString(key string, pool *redis.Pool) (string, error) {
 	conn, err := getRedisConn(pool)
 	if err != nil {
@@ -48,6 +109,72 @@ func RedisDelKey(key string, pool *redis.Pool) error {
 	return err
 }
 
+type RedisCmd struct {
+	Name string
+	Args []interface{}
+}
+
+// RedisPipeline sends all commands in one round trip, and return the first error
+func RedisPipeline(cmds []RedisCmd, pool *redis.Pool) error {
+	if len(cmds) == 0 {
+		return nil
+	}
+	conn, err := getRedisConn(pool)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, cmd := range cmds {
+		if err = conn.Send(cmd.Name, cmd.Args...); err != nil {
+			return err
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return err
+	}
+	var firstErr error
+	for range cmds {
+		if _, err = conn.Receive(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// RedisGetBits runs GETBIT for each offset in one round trip
+func RedisGetBits(key string, offsets []uint64, pool *redis.Pool) ([]bool, error) {
+	conn, err := getRedisConn(pool)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	for _, offset := range offsets {
+		if err = conn.Send("GETBIT", key, offset); err != nil {
+			return nil, err
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return nil, err
+	}
+	set := make([]bool, len(offsets))
+	for i := range offsets {
+		if set[i], err = redis.Bool(conn.Receive()); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+func RedisPing(pool *redis.Pool) error {
+	conn, err := getRedisConn(pool)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("PING")
+	return err
+}
+
 func getRedisConn(pool *redis.Pool) (redis.Conn, error) {
 	conn := pool.Get()
 	if err := conn.Err(); err != nil {
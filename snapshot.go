@@ -0,0 +1,145 @@
+package g2cache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// snapshotRecord is one line of a local storage snapshot, the value stays encoded
+type snapshotRecord struct {
+	Key   string `json:"key"`
+	Entry *Entry `json:"entry"`
+}
+
+// WithSnapshotFile New restores local storage from path if it exists, and Close dumps local storage to it.
+// The local storage must implement RangeLocalCache, a missing or broken file only logs, it never fails New
+func WithSnapshotFile(path string) Option {
+	return func(g *G2Cache) {
+		g.snapshotFile = path
+	}
+}
+
+// Snapshot writes every unexpired entry of local storage to w as JSON lines, n is the number of entries written
+func (g *G2Cache) Snapshot(w io.Writer) (n int, err error) {
+	defer func() {
+		err = withOp(OpSnapshot, err)
+	}()
+	select {
+	case <-g.stop:
+		return 0, CacheClose
+	default:
+	}
+	return g.snapshot(w)
+}
+
+func (g *G2Cache) snapshot(w io.Writer) (n int, err error) {
+	r, ok := g.local.(RangeLocalCache)
+	if !ok {
+		return 0, LocalStorageNotImplementRange
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	now := g.clock.Now()
+	rangeErr := r.Range(func(key string, e *Entry) bool {
+		if e.ExpiredAt(now) {
+			return true
+		}
+		if err = enc.Encode(&snapshotRecord{Key: key, Entry: e}); err != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	if rangeErr != nil {
+		return n, rangeErr
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// Restore sets the entries written by Snapshot into local storage, skipping the expired ones.
+// Nothing is written to out storage or published, n is the number of entries restored
+func (g *G2Cache) Restore(r io.Reader) (n int, err error) {
+	defer func() {
+		err = withOp(OpRestore, err)
+	}()
+	select {
+	case <-g.stop:
+		return 0, CacheClose
+	default:
+	}
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, readErr := br.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return n, readErr
+		}
+		if len(bytes.TrimSpace(b)) == 0 {
+			if readErr == io.EOF {
+				return n, nil
+			}
+			continue
+		}
+		rec := &snapshotRecord{Entry: &Entry{Value: rawValue()}}
+		if err = json.Unmarshal(b, rec); err != nil {
+			return n, fmt.Errorf("snapshot line %d: %v", line, err)
+		}
+		if rec.Key == "" || rec.Entry.ExpiredAt(g.clock.Now()) {
+			continue
+		}
+		if err = g.localSet(rec.Key, rec.Entry); err != nil {
+			return n, err
+		}
+		g.filterAdd(rec.Key)
+		n++
+		if readErr == io.EOF {
+			return n, nil
+		}
+	}
+}
+
+func (g *G2Cache) restoreFile() {
+	f, err := os.Open(g.snapshotFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		LogErrW("snapshot open failed", FieldGid(g.GID), Field("file", g.snapshotFile), FieldErr(err))
+		return
+	}
+	defer f.Close()
+	n, err := g.Restore(f)
+	if err != nil {
+		LogErrW("snapshot restore failed", FieldGid(g.GID), Field("file", g.snapshotFile), Field("restored", n), FieldErr(err))
+		return
+	}
+	LogInfoW("snapshot restored", FieldGid(g.GID), Field("file", g.snapshotFile), Field("restored", n))
+}
+
+// dumpFile writes to a temporary file first, so a crash never leaves a truncated snapshot behind
+func (g *G2Cache) dumpFile() {
+	tmp := g.snapshotFile + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600) // cached values are only for this user
+	if err != nil {
+		LogErrW("snapshot create failed", FieldGid(g.GID), Field("file", tmp), FieldErr(err))
+		return
+	}
+	n, err := g.snapshot(f)
+	if errC := f.Close(); err == nil {
+		err = errC
+	}
+	if err == nil {
+		err = os.Rename(tmp, g.snapshotFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		LogErrW("snapshot dump failed", FieldGid(g.GID), Field("file", g.snapshotFile), FieldErr(err))
+		return
+	}
+	LogInfoW("snapshot dumped", FieldGid(g.GID), Field("file", g.snapshotFile), Field("dumped", n))
+}
@@ -0,0 +1,117 @@
+package g2cache
+
+import (
+	stdjson "encoding/json"
+	"time"
+)
+
+// TierTTL is how long an entry has left in one storage, the durations are negative once passed
+type TierTTL struct {
+	Found       bool          `json:"found"`
+	ObsoleteTTL time.Duration `json:"obsolete_ttl"`
+	ExpireTTL   time.Duration `json:"expire_ttl"`
+}
+
+type TTLInfo struct {
+	Local TierTTL `json:"local"`
+	Out   TierTTL `json:"out"`
+}
+
+// rawValue keeps the encoded value as is, so that entries can be inspected and rewritten without knowing their type
+func rawValue() interface{} {
+	return new(stdjson.RawMessage)
+}
+
+// Touch renews Obsolete and Expiration of a cached value to ttl from now, in both storages, and publishes it to other instances.
+// The value is taken from out storage, or from local storage if out storage does not have it. It return CacheKeyNotFound if neither has it
+func (g *G2Cache) Touch(key string, ttl time.Duration, opts ...CallOption) (err error) {
+	defer func() {
+		err = withOp(OpTouch, err)
+	}()
+	select {
+	case <-g.stop:
+		return CacheClose
+	default:
+	}
+	if key == "" {
+		return CacheKeyEmpty
+	}
+	ttl, err = checkTTL(ttl)
+	if err != nil {
+		return err
+	}
+	co := newCallOptions(ttl, opts)
+	touch := func() (*Entry, error) {
+		now := g.clock.Now()
+		var e *Entry
+		var ok bool
+		var err error
+		if co.useOut() {
+			if g.batcher != nil {
+				// a batched async write of key is still pending, the touch must see it
+				if err = g.batcher.flushKey(key); err != nil {
+					return nil, err
+				}
+			}
+			e, ok, err = g.outGet(key, rawValue())
+			if err != nil {
+				return nil, err
+			}
+			ok = ok && !e.ExpiredAt(now)
+		}
+		if !ok && co.useLocal() {
+			e, ok, err = g.localGet(key, rawValue())
+			if err != nil {
+				return nil, err
+			}
+			ok = ok && !e.ExpiredAt(now)
+		}
+		if !ok {
+			return nil, CacheKeyNotFound
+		}
+		e = co.newEntry(e.Value, now)
+		return e, g.setInternal(key, e, co)
+	}
+	if co.useOut() {
+		// async writes of key queued before the touch reach out storage first
+		_, err = g.inKeyLane(key, touch)
+	} else {
+		_, err = touch()
+	}
+	if err == nil {
+		g.emit(cacheEvent{kind: eventSet, key: key})
+	}
+	return err
+}
+
+// TTL reports how long key has left in each storage, it never loads or refreshes the value
+func (g *G2Cache) TTL(key string) (info *TTLInfo, err error) {
+	defer func() {
+		err = withOp(OpTTL, err)
+	}()
+	select {
+	case <-g.stop:
+		return nil, CacheClose
+	default:
+	}
+	if key == "" {
+		return nil, CacheKeyEmpty
+	}
+	info = new(TTLInfo)
+	now := g.clock.Now()
+	e, ok, err := g.localGet(key, rawValue())
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		info.Local = TierTTL{Found: true, ObsoleteTTL: e.ObsoleteTTLAt(now), ExpireTTL: e.ExpireTTLAt(now)}
+	}
+	e, ok, err = g.outGet(key, rawValue())
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		info.Out = TierTTL{Found: true, ObsoleteTTL: e.ObsoleteTTLAt(now), ExpireTTL: e.ExpireTTLAt(now)}
+	}
+	return info, nil
+}
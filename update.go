@@ -0,0 +1,146 @@
+package g2cache
+
+import (
+	"github.com/mohae/deepcopy"
+	"time"
+)
+
+var (
+	UpdateMaxRetry = 16 // optimistic Update attempts before UpdateConflict is returned
+)
+
+// UpdateFunc gets the current value, nil if the key is missing or expired, and return the new value.
+// It may be called more than once when other writers race with the Update, so it should not have side effects
+type UpdateFunc func(old interface{}) (interface{}, error)
+
+// Update atomically replaces the value of key with fn(old) in out storage, then refreshes local storage and publishes the new value.
+// obj represents the internal structure of the value as in Get, it is filled with the new value.
+// Out storage must implement CasOutCache, unless WithLocalOnly is given. The swap runs in the key job lane of key,
+// after the async writes of key queued before it, so fn must not call Update or Touch
+func (g *G2Cache) Update(key string, ttl time.Duration, obj interface{}, fn UpdateFunc, opts ...CallOption) (err error) {
+	defer func() {
+		err = withOp(OpUpdate, err)
+	}()
+	select {
+	case <-g.stop:
+		return CacheClose
+	default:
+	}
+	if key == "" {
+		return CacheKeyEmpty
+	}
+	if obj == nil {
+		return CacheObjNil
+	}
+	if fn == nil {
+		return UpdateFuncNil
+	}
+	ttl, err = checkTTL(ttl)
+	if err != nil {
+		return err
+	}
+	co := newCallOptions(ttl, opts)
+	swap := g.updateEntry(key, fn, co)
+
+	var e *Entry
+	if co.useOut() {
+		// async writes of key queued before the update reach out storage first
+		e, err = g.inKeyLane(key, func() (*Entry, error) {
+			if g.batcher != nil {
+				// a batched async write of key is still pending, the update must see it
+				if err := g.batcher.flushKey(key); err != nil {
+					return nil, err
+				}
+			}
+			e, err := g.outUpdate(key, obj, swap)
+			if err != nil {
+				return nil, err
+			}
+			if co.useLocal() {
+				err = g.localSet(key, e)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if co.publish() {
+				err = g.publish(key, SetPublishType, e)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return e, nil
+		})
+	} else {
+		e, err = g.localUpdate(key, obj, swap)
+	}
+	if err != nil {
+		return err
+	}
+	g.filterAdd(key)
+	g.emit(cacheEvent{kind: eventSet, key: key})
+	return clone(e.Value, obj)
+}
+
+func (g *G2Cache) updateEntry(key string, fn UpdateFunc, co *callOptions) func(old *Entry) (*Entry, error) {
+	return func(old *Entry) (*Entry, error) {
+		now := g.clock.Now()
+		var v interface{}
+		if old != nil && !old.ExpiredAt(now) {
+			v = old.Value
+		}
+		nv, err := fn(v)
+		if err != nil {
+			return nil, &CacheError{Key: key, Err: err} // not a storage error
+		}
+		if nv == nil {
+			return nil, CacheObjNil
+		}
+		return co.newEntry(nv, now), nil
+	}
+}
+
+// localUpdate is serialized by the key lock, other instances are not involved
+func (g *G2Cache) localUpdate(key string, obj interface{}, swap func(old *Entry) (*Entry, error)) (*Entry, error) {
+	g.lockKey(key)
+	defer g.unlockKey(key)
+
+	old, ok, err := g.localGet(key, deepcopy.Copy(obj))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		old = nil
+	}
+	e, err := swap(old)
+	if err != nil {
+		return nil, err
+	}
+	return e, g.localSet(key, e)
+}
+
+// inKeyLane runs fn as a key job of key and waits for it, so it is ordered with the async writes of key
+func (g *G2Cache) inKeyLane(key string, fn func() (*Entry, error)) (*Entry, error) {
+	type result struct {
+		e   *Entry
+		err error
+	}
+	ch := make(chan result, 1)
+	if !g.gPool.sendKeyJob(key, func() {
+		e, err := fn()
+		ch <- result{e: e, err: err}
+	}) {
+		return nil, CacheClose
+	}
+	select {
+	case r := <-ch:
+		return r.e, r.err
+	case <-g.gPool.stopped:
+		// queued key jobs are discarded once the pool is released
+		select {
+		case r := <-ch:
+			return r.e, r.err
+		default:
+			return nil, CacheClose
+		}
+	}
+}
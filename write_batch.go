@@ -0,0 +1,271 @@
+package g2cache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	AsyncWriteBatchDelayMs = 0   // max delay of a coalesced async write before it is flushed to out storage, 0 disables write batching
+	AsyncWriteBatchSize    = 128 // a batch is flushed early once it holds this many keys
+)
+
+// writeBatcher collapses async out storage writes of the same key within a short window,
+// and flushes them with one out storage round trip and one pubsub message
+type writeBatcher struct {
+	g       *G2Cache
+	mu      sync.Mutex
+	pending map[string]*ChannelMeta
+	quiet   map[string]bool // pending keys whose write is not published
+	order   []string        // keys in first submission order
+	kick    chan struct{}
+	flushMu sync.Mutex // flushes run one at a time so that batches of the same key stay ordered
+}
+
+func newWriteBatcher(g *G2Cache) *writeBatcher {
+	return &writeBatcher{
+		g:       g,
+		pending: make(map[string]*ChannelMeta),
+		quiet:   make(map[string]bool),
+		kick:    make(chan struct{}, 1),
+	}
+}
+
+// add the last write of a key wins
+func (b *writeBatcher) add(key string, action int8, e *Entry, publish bool) {
+	b.mu.Lock()
+	if _, ok := b.pending[key]; !ok {
+		b.order = append(b.order, key)
+	}
+	b.pending[key] = &ChannelMeta{Key: key, Action: action, Data: e}
+	if publish {
+		delete(b.quiet, key)
+	} else {
+		b.quiet[key] = true
+	}
+	full := len(b.pending) >= AsyncWriteBatchSize
+	b.mu.Unlock()
+	if full {
+		select {
+		case b.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// cancel drops the pending write of a key, which is superseded by a synchronous write
+func (b *writeBatcher) cancel(key string) {
+	b.mu.Lock()
+	delete(b.pending, key)
+	delete(b.quiet, key)
+	b.mu.Unlock()
+}
+
+// take removes the pending write of a key, publish is false if the write is not published
+func (b *writeBatcher) take(key string) (meta *ChannelMeta, publish bool, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	meta, ok = b.pending[key]
+	if !ok {
+		return nil, false, false
+	}
+	publish = !b.quiet[key]
+	delete(b.pending, key)
+	delete(b.quiet, key)
+	return meta, publish, true
+}
+
+func (b *writeBatcher) takeAll() (metas []*ChannelMeta, quiet map[string]bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	metas = make([]*ChannelMeta, 0, len(b.pending))
+	for _, key := range b.order {
+		if meta, ok := b.pending[key]; ok {
+			metas = append(metas, meta)
+		}
+	}
+	quiet = b.quiet
+	b.pending = make(map[string]*ChannelMeta)
+	b.quiet = make(map[string]bool)
+	b.order = b.order[:0]
+	return metas, quiet
+}
+
+func (b *writeBatcher) run() {
+	t := b.g.clock.NewTicker(time.Duration(AsyncWriteBatchDelayMs) * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.g.stop:
+			return // the pending writes are drained by G2Cache.Shutdown
+		case <-t.C():
+			b.flush()
+		case <-b.kick:
+			b.flush()
+		}
+	}
+}
+
+func (b *writeBatcher) flush() {
+	b.drain(context.Background())
+}
+
+// drain flushes all pending writes, it return how many were dropped because ctx was done first
+func (b *writeBatcher) drain(ctx context.Context) (dropped int) {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	metas, quiet := b.takeAll()
+	for len(metas) > 0 {
+		select {
+		case <-ctx.Done():
+			return len(metas)
+		default:
+		}
+		n := len(metas)
+		if AsyncWriteBatchSize > 0 && n > AsyncWriteBatchSize {
+			n = AsyncWriteBatchSize
+		}
+		b.g.writeOutBatch(metas[:n], quiet)
+		metas = metas[n:]
+	}
+	return 0
+}
+
+// flushKey writes the pending write of key to out storage right away, so that a read of out storage that follows sees it.
+// It waits for a running flush first, which may hold an earlier write of key
+func (b *writeBatcher) flushKey(key string) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	meta, publish, ok := b.take(key)
+	if !ok {
+		return nil
+	}
+	var err error
+	if meta.Action == DelPublishType {
+		err = b.g.outDel(key)
+	} else {
+		err = b.g.outSet(key, meta.Data)
+	}
+	if err != nil {
+		atomic.AddInt64(&HitStatisticsOut.OutWriteDropTotal, 1)
+		return err
+	}
+	if meta.Action == DelPublishType {
+		// a Get may have refilled local storage from out storage before the delete reached it
+		if err = b.g.localDel(key); err != nil {
+			return err
+		}
+	}
+	if !publish {
+		return nil
+	}
+	return b.g.publish(key, meta.Action, meta.Data)
+}
+
+func (g *G2Cache) writeOutBatch(metas []*ChannelMeta, quiet map[string]bool) {
+	written := metas
+	if _, ok := g.out.(BatchOutCache); !ok {
+		written = g.writeOutEach(metas)
+	} else if err := g.outBatch(metas); err != nil {
+		LogErrW("batch out write failed, retry key by key", FieldTier(TierOut), Field("keys", len(metas)), FieldErr(err))
+		written = g.writeOutEach(metas)
+	}
+	for _, meta := range metas {
+		// a Get may have refilled local storage from out storage before the delete reached it
+		if meta.Action == DelPublishType {
+			if err := g.localDel(meta.Key); err != nil {
+				LogErrW("batch del failed", FieldKey(meta.Key), FieldTier(TierLocal), FieldErr(err))
+			}
+		}
+	}
+	// only written changes are published
+	if len(quiet) > 0 {
+		published := make([]*ChannelMeta, 0, len(written))
+		for _, meta := range written {
+			if !quiet[meta.Key] {
+				published = append(published, meta)
+			}
+		}
+		written = published
+	}
+	if len(written) == 0 {
+		return
+	}
+	if err := g.publishBatch(written); err != nil {
+		LogErrW("batch publish failed", FieldTier(TierOut), Field("keys", len(written)), FieldErr(err))
+	}
+}
+
+// writeOutEach writes metas one by one with the breaker accounting of each write, and return the ones written.
+// A failed write is dropped and counted in OutWriteDropTotal
+func (g *G2Cache) writeOutEach(metas []*ChannelMeta) []*ChannelMeta {
+	written := make([]*ChannelMeta, 0, len(metas))
+	for _, meta := range metas {
+		var err error
+		if meta.Action == DelPublishType {
+			err = g.outDel(meta.Key)
+		} else {
+			err = g.outSet(meta.Key, meta.Data)
+		}
+		if err != nil {
+			atomic.AddInt64(&HitStatisticsOut.OutWriteDropTotal, 1)
+			LogErrW("batch out write failed", FieldKey(meta.Key), FieldTier(TierOut), FieldErr(err))
+			continue
+		}
+		written = append(written, meta)
+	}
+	return written
+}
+
+func (g *G2Cache) outBatch(metas []*ChannelMeta) error {
+	batch, ok := g.out.(BatchOutCache)
+	if !ok {
+		var err error
+		for _, meta := range metas {
+			var _err error
+			if meta.Action == DelPublishType {
+				_err = g.outDel(meta.Key)
+			} else {
+				_err = g.outSet(meta.Key, meta.Data)
+			}
+			if _err != nil && err == nil {
+				err = _err
+			}
+		}
+		return err
+	}
+	if !g.breaker.allow() {
+		for _, meta := range metas {
+			g.breaker.queueDel(meta.Key)
+		}
+		return nil
+	}
+	err := batch.Batch(metas)
+	if g.breaker.done(err) {
+		g.breakerClosed()
+	}
+	return err
+}
+
+func (g *G2Cache) publishBatch(metas []*ChannelMeta) error {
+	pubsub, ok := g.out.(BatchPubSub)
+	if !ok || !OutCachePubSub {
+		var err error
+		for _, meta := range metas {
+			if _err := g.publish(meta.Key, meta.Action, meta.Data); _err != nil && err == nil {
+				err = _err
+			}
+		}
+		return err
+	}
+	if !g.breaker.allow() {
+		return nil
+	}
+	err := pubsub.PublishBatch(g.GID, metas)
+	if g.breaker.done(err) {
+		g.breakerClosed()
+	}
+	return err
+}